@@ -0,0 +1,308 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jayacarlson/dbg"
+	"github.com/jayacarlson/pth"
+	"github.com/jayacarlson/sf"
+)
+
+var (
+	opts                    sf.Options
+	help, cfgHelp, metaHelp bool
+	configFile, outputFile  string
+	cParams, cHead, cTail   string
+)
+
+const (
+	helpString = `Usage of sf:  [args] [dir list]
+  -?          Show help with output string meta-characters
+  -b          Output BASH header at start (output file made executable)
+  -B          Hardened BASH header (implies -b): stops at the first failing
+               command, only runs from the origin dir, and with DRY_RUN=1
+               set only echoes the -d / -f commands; reports the count run
+               (only with -q bash or sh)
+  -J file     Journal (implies -B): the script adds each command it ran to
+               the file, and a re-run skips those, so it resumes after the
+               last command done (delete the file to start over)
+  -c file     Config file
+  -?c         Show help on configuration file settings
+  -D          Include hidden directories
+  -F          Include hidden files
+  -h          Do not ~/homify paths (simplify full paths to ~/ if possible)
+  -I          Ignore case when filtering by file extension
+  -r          Recurse into directories
+  -s          Sort in decending order
+  -j N        Read N directories in parallel when recursing (output order is unchanged)
+               and hash N files at a time for the %{md5} ... %{crc32} tokens
+  -S          Stream huge directories in batches; output is in on-disk (unsorted)
+               order and -d lines cannot use %c / %C  (cannot combine with -s or -j)
+  -A string   Align the %{name|left} / %{name|right} columns over the whole 'run'
+               (default) or per 'dir'; output is held until then
+  -R dir      Dir the %{rel} paths are relative to (default: the origin dir)
+  -q dialect  Quote the path and name values for: bash (default), sh, fish,
+               powershell, cmd, make, or none to output them as is
+  -0          End each output line with a NUL instead of a newline, values
+               unquoted: for xargs -0 or tar --null -T -  (no -b or -q)
+  -o string   File to output data
+  -i string   File filter by list of extensions (inclusive)
+  -x string   File filter by list of extensions (exclusive)
+  -d string   Per directory output (default: "" - limited metachars: OHrRAPpDdscCT)
+  -f string   Output string per file (defaults to '%f' -- filepath)
+  -L string   Startup leading output string (limited metachars: OH)
+  -T string   Final trailing output string (limited metachars: OHT)
+  -l string   Per [dir list] directory lead output string (limited metachars: OHrRA)
+  -t string   Per [dir list] directory tail output string (limited metachars: OHrRACT)
+
+  -1 ... -9 string   Special case when using config files
+
+    If no [dir list] given, the PWD (./) is used.  A [dir list] entry may be
+    a .tar, .tar.gz, .tgz or .zip archive, walked as if it was a directory.
+
+    Only -i OR -x can be used.  To include/exclude files with no extension use '-'.
+     e.g. -[ix] "go - txt"
+`
+	metaHelpString = `The supported %meta values are as follows:
+  O   Origin path (PWD) from where sf was called, always homified
+  H   Users real HOME path: /home/<user>
+  R   Root to [dir list] path (homified by default)
+  r   Current [dir list] directory
+  P   Current full dirpath (homified by default)
+  p   Dirpath from [dir list] on down
+  D   Dirpath below [dir list] directory
+  d   Latest directory name
+  s   The file/dir size
+  c   File count inside the dir (dir output line, empty for the unread
+       sub-dirs of a non-recursive walk)
+  C   Dir count inside the dir (dir output line, as for c)
+  T   Current total file count (over all [dir list] dirs)
+  A   [dir list] archive being walked (empty for directories)
+ --- files only output
+  f   Current [dir list] filepath
+  F   Current full filepath (homified by default)
+  n   Current filename and extension as read: 'file.ext'
+  N   Current filename without any extension: 'file'
+  e   Current extension, no leading '.':      'ext'
+  E   Current file extention, with '.':       '.ext'
+  c   Current file count inside the dir
+  C   Current file count inside [dir list] dir
+
+  NOTE: the meta values r, p, d, D, f, n, N, e & E can be prepended
+   with a 'u' to uppercasify the value, or 'l' lowercasify the value.
+   e.g.:  'Dir/File.Ext' can be adjusted to
+          'DIR' | 'dir' / 'FILE' | 'file' / 'EXT' | 'ext'
+           %ur     %lr     %un      %ln      %ue     %le
+  NOTE: the numeric values c, s, C, T, uid, gid, inode, dev, nlink & seq can be
+   padded to a width of 2..9 with '0' or ' ' (also for %{name}).
+   e.g.: %05c  % 4s  %06{inode}  %08{s|hex}
+  NOTE: the meta values p, D & f can be prepended with '@' to replace
+   the dir separator '/' with '@'.  (Cannot combine with 'u' & 'l', use %{})
+   e.g.: %@f of 'dir/sub-dir/file' becomes 'dir@sub-dir@file'
+  NOTE: any %meta value can also be given as %{name|mod|mod...}, the name
+   being its character or long name, the modifiers applied left to right:
+     origin O  home H  root r  rootpath R  archive A  fullpath P  path p
+     dir D  dirname d  size s  count c  Count C  total T  file f
+     fullfile F  name n  base N  ext e  dotext E
+   Time tokens, long form only, take a format argument: %{mtime:2006-01-02}
+     mtime atime ctime   file/dir modification, access and change time (-d -f)
+     now                 time sf started (any output string)
+   the format is a Go layout, a strftime format (%Y-%m-%d %H:%M), 'unix'
+   for epoch seconds or 'age' for the time since, e.g. '3d' (s/m/h/d units);
+   by default 2006-01-02T15:04:05.
+   Mode, owner and inode tokens, long form only (-d -f), empty if not known:
+     mode  perms         permission bits in octal (0755) and as ls does (-rwxr-xr-x)
+     uid  gid  user  group   owner ids and names
+     inode  dev  nlink   inode number, device and hard link count
+   Counters, long form only (-d -f), take key=value settings after ':'
+     %{seq:name=img:start=1:step=1:pad=4:reset=dir}
+     name    counters of the same name share one count (default '')
+     start step   first value and increment (default 1 and 1)
+     pad     zero pad to this many digits
+     reset   restart per 'dir', per 'ext' (a count for each extension)
+             or per 'root' ([dir list] dir); by default never
+   a counter advances once per line using it; any settings are given once
+   Path tokens, long form only (-d -f):
+     depth               depth below the [dir list] dir, as find counts it
+     part:N              Nth component of %F / %P, 1 the first, -1 the last
+     up[:N]              full dirpath N (default 1) levels up, %{up:2} grandparent
+     rel                 %F / %P relative to the -R dir, for relative symlinks
+   Content hash tokens, long form only (-f), in hex; the files are only
+   read if used, -j N (default: a CPU count) at a time:
+     md5  sha1  sha256  crc32
+   modifiers:
+     upper  lower         change case
+     title  camel  snake  kebab   identifier case: split into words at spaces,
+                          dots, dashes, ... and case changes, then
+                          TitleCase camelCase snake_case kebab-case
+     cident               a C identifier: '_' for any other character
+     sep[:str]            replace the dir separator '/' with str (default '@')
+     replace:old:new      replace every 'old' with 'new'
+     regex:expr:repl      replace every match of the regexp, $1.. in repl
+     slice:from[:to]      runes from..to, negative counts from the end
+     maxlen:n             at most n runes
+     trimprefix:str  trimsuffix:str  trim[:chars] (default spaces)
+     si  iec              sizes in k/M/G.. units of 1000, or Ki/Mi/Gi.. of 1024
+     thousands[:sep]      digits in groups of three (default ',')
+     hex  oct             numbers in hexadecimal or octal
+     pad:width[:char]     right align in width runes (default ' ')
+     raw                  output the value unquoted, whatever the -q dialect
+     quote[:dialect]      quote the value in the dialect (default bash)
+     dq                   escape \ $ " and backquotes for inside "...",
+                          a ~/ path starting $HOME/ instead
+     left[:width]  right[:width]   align the (quoted) value in a column of
+                          width runes, without one the column is as wide as
+                          its widest value (see -A)
+   e.g.: %{f|lower|sep:@} of 'Dir/Sub-Dir/File' becomes 'dir@sub-dir@file'
+         %{N|replace: :_|maxlen:20} gives the first 20 runes, no spaces
+   Within the braces use \| \} \: and \\ for a '|' '}' ':' or '\'.
+  NOTE: use %% for a '%'.  The output strings can hold the escapes \n \t
+   \0 (NUL) \\ \xNN (byte) and \uNNNN (unicode), any other '\' is kept.
+   Bad tokens or escapes, or tokens an output string cannot use (see -help),
+   are reported with their column before any output.
+  NOTE: the path and name values (O H r R A P p D d f F n N e E, user,
+   group, part, up and rel) are quoted for the -q dialect when they hold
+   anything a shell treats specially: 'a b' in bash and sh ($'a\nb' for
+   control characters in bash).  A path starting with '-' gets a './' in
+   front, and a ~/ is kept out of the quotes.  Empty values stay empty.
+`
+	cfgHelpString = `Read the given 'configuration' file looking for 'params' 'head' and 'tail'
+blocks.  The 'params' override any given command line arguments.  The 'head'
+block is output after any bash header request (-b) and before any -H line,
+followed by file/director processing, then any -T line and finally the
+'tail' block is output.
+
+In addition to the standard %meta characters (which can be over-ridden by
+the 'params' field) the arguments -1 through -9 can be given on the command
+line and can then be used as the meta characters %1 through %9 while SF is
+processing the 'head' and 'tail' blocks.  The 'head' block can use the %meta
+characters of -L (OH), the 'tail' block those of -T (OHT).
+
+params <
+-r -h -i "jpg jpeg png gif tiff" -I
+>
+
+head <
+These are all the image files...
+>
+
+tail <
+... All done
+>
+`
+)
+
+func init() {
+	flag.BoolVar(&metaHelp, "?", false, "error")
+	flag.BoolVar(&cfgHelp, "?c", false, "error")
+	flag.BoolVar(&help, "help", false, "error")
+	flag.BoolVar(&opts.HiddenDirs, "D", false, "bool")
+	flag.BoolVar(&opts.HiddenFiles, "F", false, "bool")
+	flag.BoolVar(&opts.DontHomify, "h", false, "bool")
+	flag.BoolVar(&opts.IgnoreECase, "I", false, "bool")
+	flag.BoolVar(&opts.Recursive, "r", false, "bool")
+	flag.BoolVar(&opts.BashHeader, "b", false, "bool")
+	flag.BoolVar(&opts.Harden, "B", false, "bool")
+	flag.BoolVar(&opts.Reverse, "s", false, "bool")
+	flag.BoolVar(&opts.Stream, "S", false, "bool")
+
+	flag.IntVar(&opts.Jobs, "j", 0, "string")
+	flag.StringVar(&opts.Align, "A", "", "string")
+	flag.StringVar(&opts.RelTo, "R", "", "string")
+	flag.StringVar(&opts.Quote, "q", "", "string")
+	flag.StringVar(&opts.Journal, "J", "", "string")
+	flag.BoolVar(&opts.Null, "0", false, "bool")
+	flag.StringVar(&outputFile, "o", "", "string")
+	flag.StringVar(&opts.Include, "i", "", "string")
+	flag.StringVar(&opts.Exclude, "x", "", "string")
+	flag.StringVar(&opts.FileOutput, "f", "", "string")
+	flag.StringVar(&opts.LeadOutput, "L", "", "string")
+	flag.StringVar(&opts.TailOutput, "T", "", "string")
+	flag.StringVar(&opts.ALeadOutput, "l", "", "string")
+	flag.StringVar(&opts.ATailOutput, "t", "", "string")
+	flag.StringVar(&opts.DirOutput, "d", "", "string")
+
+	flag.StringVar(&configFile, "c", "", "error")
+	flag.StringVar(&opts.Args[0], "1", "", "error")
+	flag.StringVar(&opts.Args[1], "2", "", "error")
+	flag.StringVar(&opts.Args[2], "3", "", "error")
+	flag.StringVar(&opts.Args[3], "4", "", "error")
+	flag.StringVar(&opts.Args[4], "5", "", "error")
+	flag.StringVar(&opts.Args[5], "6", "", "error")
+	flag.StringVar(&opts.Args[6], "7", "", "error")
+	flag.StringVar(&opts.Args[7], "8", "", "error")
+	flag.StringVar(&opts.Args[8], "9", "", "error")
+}
+
+func main() {
+	var outTo *os.File = os.Stdout // default output to stdout
+	//	bug.Enabled = true
+
+	flag.Parse()
+	if help {
+		fmt.Printf("%s", helpString)
+		return
+	}
+	if metaHelp {
+		fmt.Printf("%s", metaHelpString)
+		return
+	}
+	if cfgHelp {
+		fmt.Printf("%s", cfgHelpString)
+		return
+	}
+	if "" != configFile {
+		readConfigFile(configFile)
+	}
+	opts.Head, opts.Tail = cHead, cTail
+	if opts.Harden || "" != opts.Journal {
+		opts.BashHeader = true
+	}
+
+	if opts.BashHeader {
+		args := " "
+		for _, v := range os.Args[1:] {
+			if strings.Index(v, " ") >= 0 {
+				args += `"` + v + `" `
+			} else {
+				args += v + " "
+			}
+		}
+		if "" != cParams {
+			args += "( " + cParams + " )"
+		}
+		opts.CmdLine = args
+	}
+
+	w, err := sf.NewWalker(opts)
+	if nil != err {
+		dbg.Fatal("%v", err)
+	}
+
+	if "" != outputFile {
+		outputFile = pth.AsRealPath(outputFile)
+		os.Remove(outputFile)
+		mode := 0644
+		if opts.BashHeader {
+			mode += 0100
+		}
+		file, err := os.OpenFile(outputFile, os.O_WRONLY|os.O_CREATE, os.FileMode(mode))
+		if err != nil {
+			dbg.Fatal("Failed to open output file %s", outputFile)
+		}
+		outTo = file
+	}
+
+	err = w.Run(outTo, flag.Args())
+	if "" != outputFile { // a failed close can leave the file short too
+		if cerr := outTo.Close(); nil == err {
+			err = cerr
+		}
+	}
+	if nil != err {
+		dbg.Fatal("%v", err)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"strconv"
 	"strings"
 
 	"github.com/jayacarlson/cfg"
@@ -12,37 +13,55 @@ import (
 func handleArgs(a, p string) {
 	switch a {
 	case "D":
-		hiddenDirs = true
+		opts.HiddenDirs = true
 	case "F":
-		hiddenFiles = true
+		opts.HiddenFiles = true
 	case "h":
-		dontHomify = true
+		opts.DontHomify = true
 	case "I":
-		ignoreECase = true
+		opts.IgnoreECase = true
 	case "r":
-		recursive = true
+		opts.Recursive = true
 	case "b":
-		bashHeader = true
+		opts.BashHeader = true
+	case "B":
+		opts.Harden = true
 	case "s":
-		reverse = true
+		opts.Reverse = true
+	case "S":
+		opts.Stream = true
+	case "0":
+		opts.Null = true
+	case "j":
+		n, err := strconv.Atoi(p)
+		dbg.ChkTruX(nil == err, "Invalid number for -j: %s", p)
+		opts.Jobs = n
+	case "A":
+		opts.Align = p
+	case "R":
+		opts.RelTo = p
+	case "J":
+		opts.Journal = p
+	case "q":
+		opts.Quote = p
 	case "o":
 		outputFile = p
 	case "i":
-		include = p
+		opts.Include = p
 	case "x":
-		exclude = p
+		opts.Exclude = p
 	case "f":
-		fileOutput = p
-	case "H":
-		leadOutput = p
+		opts.FileOutput = p
+	case "L":
+		opts.LeadOutput = p
 	case "T":
-		tailOutput = p
+		opts.TailOutput = p
 	case "l":
-		aLeadOutput = p
+		opts.ALeadOutput = p
 	case "t":
-		aTailOutput = p
+		opts.ATailOutput = p
 	case "d":
-		dirOutput = p
+		opts.DirOutput = p
 	}
 }
 
@@ -1,231 +1,267 @@
-package main
+// Package sf walks [dir list] directories and generates custom per directory
+// and per file output from %meta token templates, typically (bash) scripts.
+package sf
 
 import (
+	"bufio"
 	"errors"
-	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"io/fs"
 	"os"
 	"path"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jayacarlson/dbg"
 	"github.com/jayacarlson/pth"
 )
 
+// tokenMap holds the raw value of each %meta token; the path and name
+// tokens are quoted by the templates as they are output
 type tokenMap map[string]string
 
-var (
-	bug                                  = dbg.Dbg{}
-	tokRex                               = regexp.MustCompile("((?s).*?)%(.)((?s).*)")
-	tMap                                 tokenMap
-	bashHeader, reverse, dontHomify      bool
-	recursive, hiddenFiles, hiddenDirs   bool
-	ignoreECase, help, cfgHelp, metaHelp bool
-	configFile, outputFile               string
-	homifiedProcessDir, homifiedRealPath string
-	homeDir, currentFullPath             string
-	include, exclude, incList, excList   string
-	leadOutput, tailOutput               string
-	aLeadOutput, aTailOutput             string
-	dirOutput, fileOutput                string
-	cParams, cHead, cTail                string
-	cArgs                                [9]string
-	fileCount                            int64
-	totalCount                           int64 = 0
-)
+// Options carries every setting of a walk, one field per sf command line flag.
+type Options struct {
+	BashHeader  bool // -b  output BASH header at start
+	Harden      bool // -B  hardened BASH header (implies -b), each -d / -f line run by it
+	Reverse     bool // -s  sort in decending order
+	DontHomify  bool // -h  do not ~/homify paths
+	Recursive   bool // -r  recurse into directories
+	HiddenFiles bool // -F  include hidden files
+	HiddenDirs  bool // -D  include hidden directories
+	IgnoreECase bool // -I  ignore case when filtering by file extension
+
+	Include string // -i  file filter by list of extensions (inclusive)
+	Exclude string // -x  file filter by list of extensions (exclusive)
+
+	LeadOutput  string // -L  startup leading output string
+	TailOutput  string // -T  final trailing output string
+	ALeadOutput string // -l  per [dir list] directory lead output string
+	ATailOutput string // -t  per [dir list] directory tail output string
+	DirOutput   string // -d  per directory output
+	FileOutput  string // -f  per file output (defaults to '%f')
+
+	Jobs   int  // -j  number of directories read in parallel by a recursive walk
+	Stream bool // -S  stream directories in on-disk order (no -s or -j)
+
+	Align string // -A  lines aligned by %{name|left} / %{name|right}: "run" (default) or "dir"
+	RelTo string // -R  dir the %{rel} paths are relative to (default the origin dir)
+	Quote string // -q  quoting dialect of the path and name tokens: bash (default), sh, fish, powershell, cmd, make or none
+	Null  bool   // -0  end each line with a NUL, not a newline, and output the values unquoted
+
+	Journal string // -J  journal of the commands a -B script has run, which a re-run skips (implies -B)
+
+	FS fs.FS // filesystem to walk, [dir list] paths are then fs.FS paths (default: the real filesystem)
+
+	CmdLine string    // command line shown in the BASH header (%a)
+	Head    string    // config 'head' block
+	Tail    string    // config 'tail' block
+	Args    [9]string // -1 ... -9, the %1 ... %9 metas of the 'head' and 'tail' blocks
+}
+
+// Walker holds the state of a walk; each Walker is independent of any other.
+type Walker struct {
+	Options
+	tMap     tokenMap
+	fsys     fs.FS
+	scan     *scanner          // -j read ahead of the current walk
+	rooted   bool              // fsys is the real filesystem, rooted at '/'
+	needInfo bool              // the visitor of the walk uses file/dir info
+	useStat  bool              // the templates use the mode, owner or inode tokens
+	names    map[string]string // user and group names by id
+	align    bool              // lines are held to align auto width tokens
+	lines    []alignLine
+	eol      byte                // ends each output line: '\n', or NUL with -0
+	runs     int                 // the sf_run commands output, numbered for the -J journal
+	counters map[string]*counter // the %{seq} counters by name
+	seqs     struct {
+		dir, file []*counter // the counters each -d / -f line advances
+	}
+	root    Entry // values shared by every Entry of the current [dir list] dir
+	homeDir string
+	relTo   string        // real path of RelTo
+	hashes  []string      // the content hashes the visitor of the walk uses
+	hashSem chan struct{} // a slot per file being hashed
+	tmpl    struct {
+		lead, tail, aLead, aTail, dir, file, head, cTail, bash template
+	}
+	incList, excList string
+	fileCount        int64
+	totalCount       int64
+}
+
+var bug = dbg.Dbg{}
+
+// streamBatch is the number of dir entries read at a time by a -S walk
+const streamBatch = 1024
 
-const (
-	bashHead = `#!/bin/bash
+const bashHead = `#!/bin/bash
 #
 #	sf %a
 #
 `
-	helpString = `Usage of sf:  [args] [dir list]
-  -?          Show help with output string meta-characters
-  -b          Output BASH header at start (output file made executable)
-  -c file     Config file
-  -?c         Show help on configuration file settings
-  -D          Include hidden directories
-  -F          Include hidden files
-  -h          Do not ~/homify paths (simplify full paths to ~/ if possible)
-  -I          Ignore case when filtering by file extension
-  -r          Recurse into directories
-  -s          Sort in decending order
-  -o string   File to output data
-  -i string   File filter by list of extensions (inclusive)
-  -x string   File filter by list of extensions (exclusive)
-  -d string   Per directory output (default: "" - limited metachars: OHrRdDpP)
-  -f string   Output string per file (defaults to '%f' -- filepath)
-  -L string   Startup leading output string (limited metachars: OH)
-  -T string   Final trailing output string (limited metachars: OHT)
-  -l string   Per [dir list] directory lead output string (limited metachars: OHrR)
-  -t string   Per [dir list] directory tail output string (limited metachars: OHrRCT)
-
-  -1 ... -9 string   Special case when using config files
-
-    If no [dir list] given, the PWD (./) is used.
-
-    Only -i OR -x can be used.  To include/exclude files with no extension use '-'.
-     e.g. -[ix] "go - txt"
-`
-	metaHelpString = `The supported %meta values are as follows:
-  O   Origin path (PWD) from where sf was called, always homified
-  H   Users real HOME path: /home/<user>
-  R   Root to [dir list] path (homified by default)
-  r   Current [dir list] directory
-  P   Current full dirpath (homified by default)
-  p   Dirpath from [dir list] on down
-  D   Dirpath below [dir list] directory
-  d   Latest directory name
-  s   The file/dir size
-  c   File count inside the dir (dir output line)
-  C   Dir count inside the dir (dir output line)
-  T   Current total file count (over all [dir list] dirs)
- --- files only output
-  f   Current [dir list] filepath
-  F   Current full filepath (homified by default)
-  n   Current filename and extension as read: 'file.ext'
-  N   Current filename without any extension: 'file'
-  e   Current extension, no leading '.':      'ext'
-  E   Current file extention, with '.':       '.ext'
-  c   Current file count inside the dir
-  C   Current file count inside [dir list] dir
-
-  NOTE: the meta values r, p, d, D, f, n, N, e & E can be prepended
-   with a 'u' to uppercasify the value, or 'l' lowercasify the value.
-   e.g.:  'Dir/File.Ext' can be adjusted to
-          'DIR' | 'dir' / 'FILE' | 'file' / 'EXT' | 'ext'
-           %ur     %lr     %un      %ln      %ue     %le
-  NOTE: the meta values p, D & f can be prepended with '@' to replace
-   the dir separator '/' with '@'.  (Cannot combine with 'u' & 'l')
-   e.g.: %@f of 'dir/sub-dir/file' becomes 'dir@sub-dir@file'
-`
-	cfgHelpString = `Read the given 'configuration' file looking for 'params' 'head' and 'tail'
-blocks.  The 'params' override any given command line arguments.  The 'head'
-block is output after any bash header request (-b) and before any -H line,
-followed by file/director processing, then any -T line and finally the
-'tail' block is output.
-
-In addition to the standard %meta characters (which can be over-ridden by
-the 'params' field) the arguments -1 through -9 can be given on the command
-line and can then be used as the meta characters %1 through %9 while SF is 
-processing the 'head' and 'tail' blocks.
-
-params <
--r -h -i "jpg jpeg png gif tiff" -I
->
-
-head <
-These are all the image files...
->
-
-tail <
-... All done
->
+
+// hardHead follows the bashHead of a -B script: it stops at the first
+// failing command, only runs from the origin dir, and counts the -d / -f
+// commands it runs, each given to sf_run (which only echoes them when
+// DRY_RUN is set)
+const hardHead = `set -euo pipefail
+if [[ "$(pwd -P)" != "$(cd %{O|quote} 2>/dev/null && pwd -P)" ]]; then
+	echo "Run this script from %{O|dq}" >&2
+	exit 1
+fi
+SF_DONE=0
+trap 'echo "# sf: $SF_DONE command(s) ${DRY_RUN:+echoed, not }run${SF_SKIP:+, $SF_SKIP skipped as done}" >&2' EXIT
 `
-)
 
-func init() {
-	flag.BoolVar(&metaHelp, "?", false, "error")
-	flag.BoolVar(&cfgHelp, "?c", false, "error")
-	flag.BoolVar(&help, "help", false, "error")
-	flag.BoolVar(&hiddenDirs, "D", false, "bool")
-	flag.BoolVar(&hiddenFiles, "F", false, "bool")
-	flag.BoolVar(&dontHomify, "h", false, "bool")
-	flag.BoolVar(&ignoreECase, "I", false, "bool")
-	flag.BoolVar(&recursive, "r", false, "bool")
-	flag.BoolVar(&bashHeader, "b", false, "bool")
-	flag.BoolVar(&reverse, "s", false, "bool")
-
-	flag.StringVar(&outputFile, "o", "", "string")
-	flag.StringVar(&include, "i", "", "string")
-	flag.StringVar(&exclude, "x", "", "string")
-	flag.StringVar(&fileOutput, "f", "", "string")
-	flag.StringVar(&leadOutput, "L", "", "string")
-	flag.StringVar(&tailOutput, "T", "", "string")
-	flag.StringVar(&aLeadOutput, "l", "", "string")
-	flag.StringVar(&aTailOutput, "t", "", "string")
-	flag.StringVar(&dirOutput, "d", "", "string")
-
-	flag.StringVar(&configFile, "c", "", "error")
-	flag.StringVar(&cArgs[0], "1", "", "error")
-	flag.StringVar(&cArgs[1], "2", "", "error")
-	flag.StringVar(&cArgs[2], "3", "", "error")
-	flag.StringVar(&cArgs[3], "4", "", "error")
-	flag.StringVar(&cArgs[4], "5", "", "error")
-	flag.StringVar(&cArgs[5], "6", "", "error")
-	flag.StringVar(&cArgs[6], "7", "", "error")
-	flag.StringVar(&cArgs[7], "8", "", "error")
-	flag.StringVar(&cArgs[8], "9", "", "error")
-
-	homeDir = pth.AsRealPath("~")
-	tMap = make(tokenMap)
-	tMap["%"] = "%"
-	tMap.safeset("H", homeDir)
-	tMap.safeset("O", homifyDir(pth.AsRealPath(".")))
+// runFunc is the sf_run of a -B script
+const runFunc = `sf_run() {
+	if [[ -n "${DRY_RUN:-}" ]]; then
+		printf '%%s\n' "$1"
+	else
+		eval "$1"
+	fi
+	SF_DONE=$((SF_DONE + 1))
 }
+`
 
-func (t tokenMap) safeset(tok, str string) {
-	str = strings.ReplaceAll(str, ` `, `\ `)
-	str = strings.ReplaceAll(str, `(`, `\(`) // are these others needed?
-	str = strings.ReplaceAll(str, `)`, `\)`)
-	str = strings.ReplaceAll(str, `'`, `\'`)
-	str = strings.ReplaceAll(str, `"`, `\"`)
-	t[tok] = str
+// journalFunc is the sf_run of a -J script: it is given the number of the
+// command, and skips those the journal holds; the number of each command
+// run is added to the journal once it succeeds
+const journalFunc = `SF_JOURNAL=%{journal|quote}
+SF_SKIP=0
+declare -A SF_OK=()
+if [[ -f "$SF_JOURNAL" ]]; then
+	while read -r n; do SF_OK[$n]=1; done < "$SF_JOURNAL"
+fi
+sf_run() {
+	if [[ -n "${SF_OK[$1]:-}" ]]; then
+		SF_SKIP=$((SF_SKIP + 1))
+		return
+	fi
+	if [[ -n "${DRY_RUN:-}" ]]; then
+		printf '%%s\n' "$2"
+	else
+		eval "$2"
+		echo "$1" >> "$SF_JOURNAL"
+	fi
+	SF_DONE=$((SF_DONE + 1))
 }
+`
 
-func (t tokenMap) replace(src string) string {
-	if x := tokRex.FindStringSubmatch(src); x != nil {
-		vl, ok := "", false
-		if (x[2] == "0" || x[2] == " ") && (x[3][0] > '1' && x[3][0] <= '9') { // 2..9 digits
-			key := x[3][1:2]
-			vl, ok = t[key]
-			dbg.ChkTruX(ok, "Unknown replacement token: %%%s", key)
-			dbg.ChkTruX(key == "c" || key == "s" || key == "C" || key == "T",
-				"Illegal replacement token: %%%s", key)
-			flen := int(x[3][0]-'0') - len(vl)
-			x[3] = x[3][2:]
-			if flen > 0 {
-				vl = strings.Repeat(x[2], flen) + vl
-			}
-		} else if x[2] == "@" && (x[3][0] == 'p' || x[3][0] == 'D' || x[3][0] == 'f') {
-			x[2] = x[3][0:1]
-			x[3] = x[3][1:]
-			vl, _ = t[x[2]]
-			vl = strings.ReplaceAll(vl, "/", "@")
-		} else {
-			lc, uc := false, false
-			if x[2] == "u" {
-				uc = true
-			} else if x[2] == "l" {
-				lc = true
-			}
-			if uc || lc {
-				x[2] = x[3][0:1]
-				x[3] = x[3][1:]
-				dbg.ChkTruX(-1 != strings.Index("rpdDfnNeE", x[2]),
-					"Cannot change case for: %s", x[2])
-			}
-			vl, ok = t[x[2]]
-			dbg.ChkTruX(ok, "Unknown replacement token: %%%s", x[2])
-			if uc {
-				vl = strings.ToUpper(vl)
-			} else if lc {
-				vl = strings.ToLower(vl)
-			}
+// NewWalker validates the given Options and returns a Walker ready to Run.
+func NewWalker(opts Options) (*Walker, error) {
+	if "" != opts.Include && "" != opts.Exclude {
+		return nil, Err_IncExc
+	}
+	if opts.Stream && (opts.Reverse || 1 < opts.Jobs) {
+		return nil, Err_Stream
+	}
+	if "" != opts.Align && "run" != opts.Align && "dir" != opts.Align {
+		return nil, Err_Align
+	}
+	if "" != opts.Journal {
+		opts.Harden = true
+	}
+	if opts.Harden {
+		opts.BashHeader = true
+	}
+	if _, ok := dialects[opts.Quote]; !ok && "" != opts.Quote {
+		return nil, Err_Quote
+	}
+	if opts.Null && (opts.BashHeader || "" != opts.Quote) {
+		return nil, Err_Null
+	}
+	if opts.Harden && "" != opts.Quote && "bash" != opts.Quote && "sh" != opts.Quote {
+		return nil, Err_Harden // sf_run evals each line in bash
+	}
+	w := &Walker{Options: opts, tMap: make(tokenMap), names: map[string]string{}, counters: map[string]*counter{}, eol: '\n'}
+	if w.Null {
+		w.Quote, w.eol = "none", 0
+	}
+	if "" != w.Include {
+		if w.IgnoreECase {
+			w.Include = strings.ToLower(w.Include)
 		}
-		return x[1] + vl + t.replace(x[3])
+		w.incList = " " + w.Include + " "
+	}
+	if "" != w.Exclude {
+		if w.IgnoreECase {
+			w.Exclude = strings.ToLower(w.Exclude)
+		}
+		w.excList = " " + w.Exclude + " "
+	}
+	if "" == w.DirOutput && "" == w.FileOutput {
+		w.FileOutput = "%f"
+	}
+	dToks := dirToks
+	if w.Stream {
+		dToks = sDirToks
+	}
+	head := bashHead
+	switch {
+	case "" != w.Journal:
+		head += hardHead + journalFunc
+	case w.Harden:
+		head += hardHead + runFunc
+	}
+	for _, c := range []struct {
+		tmpl    *template
+		name    string
+		src     string
+		escapes bool
+		toks    string
+	}{
+		{&w.tmpl.lead, "-L", w.LeadOutput, true, leadToks + nowTok},
+		{&w.tmpl.tail, "-T", w.TailOutput, true, tailToks + nowTok},
+		{&w.tmpl.aLead, "-l", w.ALeadOutput, true, aLeadToks + nowTok},
+		{&w.tmpl.aTail, "-t", w.ATailOutput, true, aTailToks + nowTok},
+		{&w.tmpl.dir, "-d", w.DirOutput, true, dToks + entryToks + nowTok + seqTok + pathToks},
+		{&w.tmpl.file, "-f", w.FileOutput, true, fileToks + entryToks + nowTok + seqTok + pathToks + hashToks},
+		{&w.tmpl.head, "head", w.Head, false, leadToks + argToks + nowTok},
+		{&w.tmpl.cTail, "tail", w.Tail, false, tailToks + argToks + nowTok},
+		{&w.tmpl.bash, "bash header", head, false, bashToks},
+	} {
+		var err error
+		if *c.tmpl, err = compileTmpl(c.name, c.src, c.escapes, c.toks); nil != err {
+			return nil, err
+		}
+		if "" != w.Quote {
+			c.tmpl.setDialect(w.Quote)
+		}
+	}
+
+	var err error
+	if w.seqs.dir, err = w.setCounters("-d", w.tmpl.dir); nil != err {
+		return nil, err
+	}
+	if w.seqs.file, err = w.setCounters("-f", w.tmpl.file); nil != err {
+		return nil, err
+	}
+	w.useStat = w.tmpl.dir.uses(statToks) || w.tmpl.file.uses(statToks)
+	for _, t := range []template{w.tmpl.lead, w.tmpl.tail, w.tmpl.aLead, w.tmpl.aTail, w.tmpl.dir, w.tmpl.file, w.tmpl.head, w.tmpl.cTail} {
+		w.align = w.align || 0 < t.autoCols()
+	}
+
+	w.fsys, w.rooted = w.FS, nil == w.FS
+	if w.rooted {
+		w.fsys = os.DirFS("/")
 	}
-	return src
-}
 
-func (t tokenMap) output(outTo io.Writer, src string) {
-	outLine := strings.ReplaceAll(t.replace(src), "\\n", "\n")
-	fmt.Fprintln(outTo, outLine)
+	w.homeDir = pth.AsRealPath("~")
+	w.relTo = path.Clean(w.RelTo)
+	if w.rooted {
+		if w.relTo = pth.AsRealPath(w.relTo); !strings.HasPrefix(w.relTo, "/") {
+			w.relTo = pth.AsRealPath("./" + w.RelTo)
+		}
+	}
+	w.tMap["%"] = "%"
+	w.tMap["now"] = timeVal(time.Now())
+	w.tMap["H"] = w.homeDir
+	w.tMap["O"] = w.homify(pth.AsRealPath(".")) // always homified
+	return w, nil
 }
 
 func (t tokenMap) String() string {
@@ -236,294 +272,480 @@ func (t tokenMap) String() string {
 	return out + "]"
 }
 
-func homifyDir(theDir string) string {
-	if !dontHomify {
-		if len(theDir) >= len(homeDir) {
-			if theDir[:len(homeDir)] == homeDir {
-				theDir = "~" + theDir[len(homeDir):]
-			}
+func (w *Walker) homify(theDir string) string {
+	if len(theDir) >= len(w.homeDir) {
+		if theDir[:len(w.homeDir)] == w.homeDir {
+			theDir = "~" + theDir[len(w.homeDir):]
 		}
 	}
 	return theDir
 }
 
-func addNumberArgs() {
-	if "" != cArgs[0] {
-		tMap["1"] = cArgs[0]
-	}
-	if "" != cArgs[1] {
-		tMap["2"] = cArgs[1]
-	}
-	if "" != cArgs[2] {
-		tMap["3"] = cArgs[2]
-	}
-	if "" != cArgs[3] {
-		tMap["4"] = cArgs[3]
+func (w *Walker) homifyDir(theDir string) string {
+	if !w.DontHomify && w.rooted {
+		theDir = w.homify(theDir)
 	}
-	if "" != cArgs[4] {
-		tMap["5"] = cArgs[4]
-	}
-	if "" != cArgs[5] {
-		tMap["6"] = cArgs[5]
-	}
-	if "" != cArgs[6] {
-		tMap["7"] = cArgs[6]
-	}
-	if "" != cArgs[7] {
-		tMap["8"] = cArgs[7]
-	}
-	if "" != cArgs[8] {
-		tMap["9"] = cArgs[8]
+	return theDir
+}
+
+// realPath joins path elements into a path of the walked filesystem
+func (w *Walker) realPath(elem ...string) string {
+	if !w.rooted {
+		return path.Join(elem...)
 	}
+	return pth.AsRealPath(elem...)
 }
-func clearNumberArgs() {
-	delete(tMap, "0") // remove any number metachars
-	delete(tMap, "1")
-	delete(tMap, "2")
-	delete(tMap, "3")
-	delete(tMap, "4")
-	delete(tMap, "5")
-	delete(tMap, "6")
-	delete(tMap, "7")
-	delete(tMap, "8")
+
+// fsPath converts a realPath into the unrooted form fs.FS expects
+func (w *Walker) fsPath(realPath string) string {
+	if w.rooted {
+		if realPath = strings.TrimPrefix(realPath, "/"); "" == realPath {
+			return "."
+		}
+	}
+	return realPath
 }
 
-func clearFileMetas() {
-	delete(tMap, "c") // remove any previous 'file' metachars
-	delete(tMap, "C")
-	delete(tMap, "T")
-	delete(tMap, "f")
-	delete(tMap, "F")
-	delete(tMap, "n")
-	delete(tMap, "N")
-	delete(tMap, "e")
-	delete(tMap, "E")
+func (w *Walker) addNumberArgs() {
+	for i, a := range w.Args { // any not given is empty
+		w.tMap[strconv.Itoa(i+1)] = a
+	}
 }
 
-func clearDirMetas() {
-	delete(tMap, "c") // remove any previous 'dir' metachars
-	delete(tMap, "C")
-	delete(tMap, "d")
-	delete(tMap, "D")
-	delete(tMap, "p")
-	delete(tMap, "P")
-	delete(tMap, "s")
+func (w *Walker) clearNumberArgs() {
+	for i := range w.Args { // remove any number metachars
+		delete(w.tMap, strconv.Itoa(i+1))
+	}
 }
 
-func handleFiles(outTo io.Writer, dirPath string, fileNames []string) error {
+// handleFiles visits the files of a dir scan, count being the number of
+// files of the dir already visited; returns the new count
+func (w *Walker) handleFiles(v Visitor, dir *Entry, dirPath string, ds *dirScan, count int64) (int64, error) {
 	var nm, ext string
-	var count int64 = 0
-	for _, fileName := range fileNames {
-		realPath := pth.AsRealPath(dirPath, fileName)
+	hb := w.hashFiles(dirPath, ds)
+	for i, de := range ds.files {
+		fileName := de.Name()
+		realPath := w.realPath(dirPath, fileName)
+		e := &Entry{
+			Root:     dir.Root,
+			RootPath: dir.RootPath,
+			Archive:  dir.Archive,
+			Path:     dir.Path,
+			Dir:      dir.Dir,
+			Name:     fileName,
+			FullPath: path.Clean(dir.FullPath + "/" + fileName),
+			Depth:    dir.Depth + 1,
+			de:       de,
+		}
+		if nil != hb {
+			e.sums = hb.get(i)
+		}
 
-		fi, err := os.Stat(realPath)
-		err = chkErr(err)
-		if nil != err {
-			if err == Err_NotExist {
+		if w.needInfo {
+			e.info, e.infoErr = ds.infos[i], ds.infoErrs[i]
+			if err := chkErr(e.infoErr); nil != err {
+				if err != Err_NotExist {
+					dbg.Error("Error %v for file `%s`", err, realPath)
+				}
+				if err = v.OnError(e, err); nil != err {
+					return count, err
+				}
 				continue
 			}
-			dbg.Error("Error %v for file `%s`", err, realPath)
-			return err
+			e.Size = e.info.Size()
 		}
 
-		tMap.safeset("n", fileName)
 		_, nm, ext = pth.Split(realPath)
-
-		tMap.safeset("N", nm)
-		tMap.safeset("E", ext)
-		if ext != "" {
-			ext = ext[1:]
+		count += 1
+		w.fileCount += 1
+		w.totalCount += 1
+		e.Base = nm
+		e.Ext = ext
+		e.Count = count
+		e.RootCount = w.fileCount
+		e.Total = w.totalCount
+		if dir.Path == "." {
+			e.File = fileName
+		} else {
+			e.File = dir.Path + "/" + fileName
 		}
-		tMap.safeset("e", ext)
-
-		if ignoreECase {
-			ext = strings.ToLower(ext)
+		if err := v.OnFile(e); nil != err {
+			return count, err
 		}
+	}
+	return count, nil
+}
 
-		count += 1
-		fileCount += 1
-		totalCount += 1
-		tMap["c"] = strconv.FormatInt(count, 10)
-		tMap["C"] = strconv.FormatInt(fileCount, 10)
-		tMap["T"] = strconv.FormatInt(totalCount, 10)
-		tMap["s"] = strconv.FormatInt(fi.Size(), 10)
-		tMap.safeset("F", path.Clean(homifiedRealPath+"/"+fileName))
-		if tMap["p"] == "." {
-			tMap.safeset("f", fileName)
+// dirFrame is an entered directory whose sub-dirs are still to be visited
+type dirFrame struct {
+	e       *Entry
+	curPath string
+	dirs    []fs.DirEntry
+	next    int
+}
+
+// handleDir walks the directory curDir found below dirPath and, when
+// recursive, every directory below it.  The walk keeps its own stack of
+// entered dirs, the Go stack does not grow with the depth of the tree.
+func (w *Walker) handleDir(v Visitor, dirRoot, dirPath, curDir string) error {
+	f, err := w.enterDir(v, dirRoot, dirPath, curDir, nil)
+	if nil == f {
+		return err
+	}
+	stack := []*dirFrame{f}
+	for 0 < len(stack) {
+		f = stack[len(stack)-1]
+		if f.next == len(f.dirs) {
+			stack = stack[:len(stack)-1]
+			if err = v.OnDirLeave(f.e); nil != err {
+				return err
+			}
+			continue
+		}
+		de := f.dirs[f.next]
+		f.next++
+		if !w.Recursive {
+			err = w.shallowDir(v, dirRoot, f.curPath, de)
 		} else {
-			tMap.safeset("f", currentFullPath+"/"+fileName)
+			var sub *dirFrame
+			if sub, err = w.enterDir(v, dirRoot, f.curPath, de.Name(), de); nil != sub {
+				stack = append(stack, sub)
+			}
+		}
+		if nil != err {
+			return err
 		}
-		tMap.output(outTo, fileOutput)
 	}
 	return nil
 }
 
-func handleDir(outTo io.Writer, dirRoot, dirPath, curDir string) error {
-	theDirs := []string{}
-	theFiles := []string{}
-	realPath := pth.AsRealPath(dirRoot, dirPath, curDir)
+// enterDir visits a directory and its files, returning the frame for its
+// sub-dirs; nil if the dir is skipped or the walk ends.  de is the dir's
+// entry in its parent, nil for the [dir list] directory.
+func (w *Walker) enterDir(v Visitor, dirRoot, dirPath, curDir string, de fs.DirEntry) (*dirFrame, error) {
+	realPath := w.realPath(dirRoot, dirPath, curDir)
 	curPath := path.Join(dirPath, curDir)
+	e := w.dirEntry(realPath, curPath, curDir)
+	e.de = de
 
 	bug.Warning("handleDir: dirRoot: %s  dirPath: %s  curDir: %s", dirRoot, dirPath, curDir)
 	//bug.Info("realPath: %s", realPath)
 	//bug.Info("curPath:  %s", curPath)
 
-	// validate latest realPath, (test dirs in recursion situation)
-	//  should only possibly get Err_Permission
-	fi, err := os.Stat(realPath)
-	err = chkDirErr(realPath, err)
+	if w.Stream {
+		return w.streamDir(v, e, realPath)
+	}
+
+	ds := w.readDir(w.fsPath(realPath), de)
+	err := chkDirErr(realPath, ds.statErr)
 	if nil != err {
-		return err
+		return nil, v.OnError(e, err)
+	}
+	err = chkErr(ds.readErr)
+	if nil != err {
+		if err == Err_Permission {
+			dbg.Warning("Failed to open restricted dir: `%s`", realPath)
+		}
+		return nil, v.OnError(e, err)
 	}
 
-	entries, err := ioutil.ReadDir(realPath)
-	err = chkErr(err)
+	if nil != ds.fi {
+		e.info, e.Size = ds.fi, ds.fi.Size()
+	}
+	e.Files = int64(len(ds.files))
+	e.Dirs = int64(len(ds.dirs))
+	e.Total = w.totalCount
+	if err = v.OnDirEnter(e); nil != err {
+		return nil, err
+	}
+	if _, err = w.handleFiles(v, e, realPath, ds, 0); nil != err {
+		return nil, err
+	}
+	return &dirFrame{e: e, curPath: curPath, dirs: ds.dirs}, nil
+}
+
+// streamDir is enterDir for -S: the dir is read streamBatch entries at a
+// time, and its files are visited batch by batch in the on-disk order.  Only
+// the sub-dir names are held; the file and dir counts are not known up front.
+func (w *Walker) streamDir(v Visitor, e *Entry, realPath string) (*dirFrame, error) {
+	fsPath := w.fsPath(realPath)
+	fi, err := w.dirInfo(fsPath, e.de)
+	err = chkDirErr(realPath, err)
 	if nil != err {
+		return nil, v.OnError(e, err)
+	}
+	f, err := w.fsys.Open(fsPath)
+	if nil == err {
+		defer f.Close()
+	}
+	rd, ok := f.(fs.ReadDirFile)
+	if nil == err && !ok {
+		err = &fs.PathError{Op: "readdir", Path: fsPath, Err: errors.ErrUnsupported}
+	}
+	if err = chkErr(err); nil != err {
 		if err == Err_Permission {
 			dbg.Warning("Failed to open restricted dir: `%s`", realPath)
-			return nil
 		}
-		return err
+		return nil, v.OnError(e, err)
 	}
 
-	for _, entry := range entries {
-		if entry.IsDir() {
-			if !hiddenDirs && len(entry.Name()) > 1 && entry.Name()[0] == '.' {
-				continue
-			}
-			theDirs = append(theDirs, entry.Name())
-		} else {
-			if !entry.Mode().IsRegular() {
-				continue
-			}
-			if !hiddenFiles && entry.Name()[0] == '.' {
-				continue
-			}
-			if "" != incList || "" != excList {
-				_, _, ext := pth.Split(entry.Name())
-				if ext != "" {
-					ext = ext[1:]
-				} else {
-					ext = "-"
-				}
-				if ignoreECase {
-					ext = strings.ToLower(ext)
-				}
+	if nil != fi {
+		e.info, e.Size = fi, fi.Size()
+	}
+	e.Files, e.Dirs = -1, -1
+	e.Total = w.totalCount
+	if err = v.OnDirEnter(e); nil != err {
+		return nil, err
+	}
 
-				if "" != incList && -1 == strings.Index(incList, " "+ext+" ") {
-					continue
-				}
-				if "" != excList && -1 != strings.Index(excList, " "+ext+" ") {
-					continue
-				}
+	var count int64
+	dirs := []fs.DirEntry{}
+	for {
+		entries, rerr := rd.ReadDir(streamBatch)
+		ds := &dirScan{}
+		w.filter(ds, entries)
+		w.statFiles(ds)
+		dirs = append(dirs, ds.dirs...)
+		if count, err = w.handleFiles(v, e, realPath, ds, count); nil != err {
+			return nil, err
+		}
+		if io.EOF == rerr || (nil == rerr && 0 == len(entries)) {
+			break
+		}
+		if nil != rerr {
+			if err = v.OnError(e, chkErr(rerr)); nil != err {
+				return nil, err
 			}
-			theFiles = append(theFiles, entry.Name())
+			break
 		}
 	}
+	return &dirFrame{e: e, curPath: e.Dir, dirs: dirs}, nil
+}
 
-	if reverse {
-		for b, e := 0, len(theDirs)-1; b < e; b, e = b+1, e-1 {
-			theDirs[b], theDirs[e] = theDirs[e], theDirs[b]
-		}
+// shallowDir reports, without entering, a sub-directory of a non-recursive walk
+func (w *Walker) shallowDir(v Visitor, dirRoot, dirPath string, de fs.DirEntry) error {
+	realPath := w.realPath(dirRoot, dirPath, de.Name())
+	e := w.dirEntry(realPath, path.Join(dirPath, de.Name()), de.Name())
+	e.Shallow = true
+	e.Files, e.Dirs = -1, -1
+	e.Total = w.totalCount
+	e.de = de
+	fi, err := w.dirInfo(w.fsPath(realPath), de)
+	err = chkDirErr(realPath, err)
+	if nil != err {
+		return v.OnError(e, err)
+	}
+	if nil != fi {
+		e.info, e.Size = fi, fi.Size()
+	}
+	if err = v.OnDirEnter(e); nil != err {
+		return err
 	}
+	return v.OnDirLeave(e)
+}
 
-	clearFileMetas()
-	homifiedRealPath = homifyDir(realPath)
-	currentFullPath = path.Join(homifiedProcessDir, curPath)
-	tMap.safeset("P", homifiedRealPath)
-	tMap.safeset("p", currentFullPath)
-	tMap.safeset("D", curPath)
-	tMap.safeset("d", curDir)
-	tMap["s"] = strconv.FormatInt(fi.Size(), 10)
-	tMap["c"] = strconv.FormatInt(int64(len(theFiles)), 10)
-	tMap["C"] = strconv.FormatInt(int64(len(theDirs)), 10)
-	tMap["T"] = strconv.FormatInt(totalCount, 10)
+// isDir reports if realPath is a directory
+func (w *Walker) isDir(realPath string) bool {
+	fi, err := fs.Stat(w.fsys, w.fsPath(realPath))
+	return nil == err && fi.IsDir()
+}
 
-	// output dir lead (argDir / recursive)
-	if dirOutput != "" {
-		tMap.output(outTo, dirOutput)
+// dirEntry returns the Entry of a directory, curPath being its dirpath below
+// the [dir list] directory
+func (w *Walker) dirEntry(realPath, curPath, curDir string) *Entry {
+	return &Entry{
+		Root:     w.root.Root,
+		RootPath: w.root.RootPath,
+		Archive:  w.root.Archive,
+		Path:     path.Join(w.root.Path, curPath),
+		FullPath: w.homifyDir(realPath),
+		Dir:      curPath,
+		Name:     curDir,
+		Depth:    dirDepth(curPath),
+		IsDir:    true,
 	}
+}
 
-	if fileOutput != "" {
-		if reverse {
-			for b, e := 0, len(theFiles)-1; b < e; b, e = b+1, e-1 {
-				theFiles[b], theFiles[e] = theFiles[e], theFiles[b]
-			}
+// VisitDir walks a single [dir list] directory, calling v for the root,
+// every directory and every file.  A [dir list] archive (see IsArchive) is
+// walked as if it was a directory; a directory with an archive's name is
+// walked as one.
+func (w *Walker) VisitDir(v Visitor, curDir string) error {
+	curDir = path.Clean(curDir)
+	dirRoot := curDir
+	if w.rooted {
+		dirRoot = pth.AsRealPath(curDir)
+		if dirRoot[0] != '/' {
+			dirRoot = pth.AsRealPath("./" + curDir)
 		}
-		err = handleFiles(outTo, realPath, theFiles)
-		if nil != err {
-			return err
+	}
+	w.fileCount = 0
+	w.root = Entry{
+		Root:     w.homifyDir(curDir),
+		RootPath: w.homifyDir(dirRoot),
+		Path:     w.homifyDir(curDir),
+		FullPath: w.homifyDir(dirRoot),
+		Dir:      ".",
+		Name:     ".",
+		IsDir:    true,
+		Total:    w.totalCount,
+	}
+	root := w.root
+	if IsArchive(curDir) && !w.isDir(dirRoot) {
+		w.root.Archive = w.root.Root
+		w.root.Path = "."
+		root = w.root
+	}
+	w.needInfo = true
+	if n, ok := v.(FileInfoNeeder); ok {
+		w.needInfo = n.NeedFileInfo()
+	}
+	w.hashes = nil
+	if n, ok := v.(HashNeeder); ok {
+		for _, k := range n.NeedHashes() {
+			if _, ok := hashFuncs[k]; ok {
+				w.hashes = append(w.hashes, k)
+			}
 		}
+	}
+	if err := v.OnRootStart(&root); nil != err {
+		return err
+	}
+
+	var err error
+	if "" == root.Archive {
+		stop := w.startScan(w.fsys)
+		err = w.handleDir(v, dirRoot, ".", ".")
+		stop()
 	} else {
-		totalCount += int64(len(theFiles))
+		err = w.handleArchive(v, &root, dirRoot)
 	}
+	root.RootCount = w.fileCount
+	root.Total = w.totalCount
+	if rerr := v.OnRootEnd(&root); nil == err {
+		err = rerr
+	}
+	return err
+}
 
-	if 0 < len(theDirs) {
-		for _, dirName := range theDirs {
-			if recursive {
-				err = handleDir(outTo, dirRoot, curPath, dirName)
-				if nil != err {
-					return err
-				}
-			} else if dirOutput != "" {
-				realPath := pth.AsRealPath(dirRoot, curPath, dirName)
-				fi, err := os.Stat(realPath)
-				err = chkDirErr(realPath, err)
-				if nil != err {
-					return err
-				}
-				homifiedRealPath = homifyDir(realPath)
-				tMap["s"] = strconv.FormatInt(fi.Size(), 10)
-				tMap.safeset("P", homifiedRealPath)
-				tMap.safeset("d", dirName)
-				tMap.output(outTo, dirOutput)
-			}
+// handleArchive walks the members of the archive at realPath
+func (w *Walker) handleArchive(v Visitor, root *Entry, realPath string) error {
+	afs, closer, err := openArchive(w.fsys, w.fsPath(realPath), w.hashes)
+	if nil != err {
+		if err = chkErr(err); Err_NotExist == err || Err_Permission == err {
+			dbg.Warning("Failed to open archive: `%s`", realPath)
+		} else {
+			dbg.Error("Error %v for archive `%s`", err, realPath)
 		}
+		return v.OnError(root, err)
 	}
+	defer closer.Close()
+
+	fsys, rooted := w.fsys, w.rooted
+	w.fsys, w.rooted = afs, false
+	defer func() { w.fsys, w.rooted = fsys, rooted }()
+	defer w.startScan(afs)()
+	return w.handleDir(v, ".", ".", ".")
+}
 
+// Visit walks every directory of the [dir list] in turn, calling v for each
+// root, directory and file.  If no dirs are given the PWD (./) is used.
+// The walk stops at the first error.
+func (w *Walker) Visit(v Visitor, dirs []string) error {
+	if len(dirs) == 0 {
+		dirs = append(dirs, "./")
+	}
+	for _, curDir := range dirs {
+		if err := w.VisitDir(v, curDir); nil != err {
+			return err
+		}
+	}
 	return nil
 }
 
-func processDir(outTo io.Writer, curDir string) error {
-	curDir = path.Clean(curDir)
-	dirRoot := pth.AsRealPath(curDir)
-	if dirRoot[0] != '/' {
-		dirRoot = pth.AsRealPath("./" + curDir)
-	}
-	homifiedProcessDir = homifyDir(curDir)
-	tMap.safeset("R", homifyDir(dirRoot))
-	tMap.safeset("r", homifiedProcessDir)
-	fileCount = 0
-	if aLeadOutput != "" {
-		clearFileMetas()
-		clearDirMetas()
-		tMap.output(outTo, aLeadOutput)
-	}
-	err := handleDir(outTo, dirRoot, ".", ".")
-	if aTailOutput != "" {
-		clearFileMetas()
-		clearDirMetas()
-		tMap["T"] = strconv.FormatInt(totalCount, 10)
-		tMap.output(outTo, aTailOutput)
+// ProcessDir walks a single [dir list] directory, including its -l / -t
+// lead and tail output.
+func (w *Walker) ProcessDir(outTo io.Writer, curDir string) error {
+	out := bufio.NewWriter(outTo)
+	err := w.VisitDir(&textVisitor{w: w, out: out}, curDir)
+	w.flushLines(out)
+	if ferr := out.Flush(); nil == err {
+		err = ferr
 	}
 	return err
 }
 
+// Run generates the complete output for the given [dir list]: the BASH
+// header, config 'head', -L lead, every directory, -T tail and config
+// 'tail'.  If no dirs are given the PWD (./) is used.  All dirs are
+// processed; the first error encountered is returned.
+func (w *Walker) Run(outTo io.Writer, dirs []string) error {
+	var rtn error
+	out := bufio.NewWriter(outTo)
+	tv := &textVisitor{w: w, out: out}
+	w.runs = 0
+
+	if w.BashHeader { // a newline would end the comment
+		w.tMap["a"] = strings.ReplaceAll(w.CmdLine, "\n", " ")
+		w.tMap["journal"] = w.Journal
+		w.output(out, &w.tmpl.bash)
+		delete(w.tMap, "a")
+	}
+	if "" != w.Head {
+		w.addNumberArgs()
+		w.output(out, &w.tmpl.head)
+		w.clearNumberArgs()
+	}
+	if len(dirs) == 0 {
+		dirs = append(dirs, "./")
+	}
+
+	if w.LeadOutput != "" {
+		w.output(out, &w.tmpl.lead)
+	}
+	for _, curDir := range dirs {
+		if err := w.VisitDir(tv, curDir); nil != err && nil == rtn {
+			rtn = err
+		}
+	}
+	w.tMap["T"] = strconv.FormatInt(w.totalCount, 10)
+	if w.TailOutput != "" {
+		w.output(out, &w.tmpl.tail)
+	}
+	if "" != w.Tail {
+		w.addNumberArgs()
+		w.output(out, &w.tmpl.cTail)
+		w.clearNumberArgs()
+	}
+	w.flushLines(out)
+	if err := out.Flush(); nil == rtn {
+		rtn = err
+	}
+	return rtn
+}
+
 var (
 	Err_NotExist   = errors.New("File/dir doesn't exist")
 	Err_Permission = errors.New("Permission Denied")
+	Err_IncExc     = errors.New("Can only use -i or -x, not both")
+	Err_Stream     = errors.New("Cannot use -S with -s or -j")
+	Err_Align      = errors.New("-A must be 'run' or 'dir'")
+	Err_NotHashed  = errors.New("Hash not asked for by the visitor")
+	Err_Quote      = errors.New("-q must be bash, sh, fish, powershell, cmd, make or none")
+	Err_Null       = errors.New("Cannot use -0 with -b or -q")
+	Err_Harden     = errors.New("-B and -J can only be used with -q bash or sh")
 )
 
 func chkErr(err error) error {
 	if nil != err {
+		if errors.Is(err, fs.ErrNotExist) {
+			return Err_NotExist
+		}
+		if errors.Is(err, fs.ErrPermission) {
+			return Err_Permission
+		}
 		switch t := err.(type) {
-		case *os.PathError:
-			if os.IsNotExist(err) {
-				return Err_NotExist
-			}
-			if os.IsPermission(err) {
-				return Err_Permission
-			}
+		case *fs.PathError:
 			dbg.Message("OS path err: %v", err)
 		default:
 			dbg.Message("Path err type: %v", t)
@@ -565,102 +787,3 @@ func chkFileErr(realPath string, err error) error {
 		return err
 	}
 }
-
-func main() {
-	var outTo *os.File = os.Stdout // default output to stdout
-	//	bug.Enabled = true
-
-	flag.Parse()
-	if help {
-		fmt.Printf("%s", helpString)
-		return
-	}
-	if metaHelp {
-		fmt.Printf("%s", metaHelpString)
-		return
-	}
-	if cfgHelp {
-		fmt.Printf("%s", cfgHelpString)
-		return
-	}
-	if "" != configFile {
-		readConfigFile(configFile)
-	}
-	if "" != include && "" != exclude {
-		dbg.Fatal("Can only use -i or -x, not both")
-	}
-	if "" != include {
-		if ignoreECase {
-			include = strings.ToLower(include)
-		}
-		incList = " " + include + " "
-	}
-	if "" != exclude {
-		if ignoreECase {
-			exclude = strings.ToLower(exclude)
-		}
-		excList = " " + exclude + " "
-	}
-	if "" == dirOutput && "" == fileOutput {
-		fileOutput = "%f"
-	}
-
-	if "" != outputFile {
-		outputFile = pth.AsRealPath(outputFile)
-		os.Remove(outputFile)
-		mode := 0644
-		if bashHeader {
-			mode += 0100
-		}
-		file, err := os.OpenFile(outputFile, os.O_WRONLY|os.O_CREATE, os.FileMode(mode))
-		if err != nil {
-			dbg.Fatal("Failed to open output file %s", outputFile)
-		}
-		outTo = file
-		defer outTo.Close()
-	}
-
-	if bashHeader {
-		args := " "
-		for _, v := range os.Args[1:] {
-			if strings.Index(v, " ") >= 0 {
-				args += `"` + v + `" `
-			} else {
-				args += v + " "
-			}
-		}
-		if "" != cParams {
-			args += "( " + cParams + " )"
-		}
-		tMap["a"] = args
-		fmt.Fprintln(outTo, tMap.replace(bashHead))
-		delete(tMap, "a")
-	}
-	if "" != cHead {
-		addNumberArgs()
-		fmt.Fprintln(outTo, tMap.replace(cHead))
-		clearNumberArgs()
-	}
-	dirs := flag.Args()
-	if len(dirs) == 0 {
-		dirs = append(dirs, "./")
-	}
-
-	if leadOutput != "" {
-		tMap.output(outTo, leadOutput)
-	}
-	for _, curDir := range dirs {
-		processDir(outTo, curDir)
-	}
-	if tailOutput != "" {
-		clearFileMetas()
-		clearDirMetas()
-		tMap["T"] = strconv.FormatInt(totalCount, 10)
-		tMap.output(outTo, tailOutput)
-	}
-	if "" != cTail {
-		addNumberArgs()
-		fmt.Fprintln(outTo, tMap.replace(cTail))
-		clearNumberArgs()
-	}
-}
@@ -0,0 +1,150 @@
+package sf
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// setAlign sets the alignment of a %{name|left[:width]} or right token; with
+// no width the token is aligned to the widest value of its column
+func (n *tmplNode) setAlign(how string, args []string) error {
+	if 0 != n.align {
+		return fmt.Errorf("token already aligned")
+	}
+	if err := wantArgs(args, 0, 1); nil != err {
+		return err
+	}
+	n.align = '>'
+	if "left" == how {
+		n.align = '<'
+	}
+	if 1 == len(args) {
+		width, err := intArg(args[0])
+		if nil != err || 1 > width {
+			return fmt.Errorf("%q is not a width", args[0])
+		}
+		n.alignW = width
+	}
+	return nil
+}
+
+// alignText pads s with spaces to width runes, on its right if aligned left
+func alignText(s string, align byte, width int) string {
+	n := width - utf8.RuneCountInString(s)
+	if 0 >= n {
+		return s
+	}
+	if '<' == align {
+		return s + strings.Repeat(" ", n)
+	}
+	return strings.Repeat(" ", n) + s
+}
+
+// autoCols is the number of tokens of t aligned to the widest of their column
+func (t template) autoCols() int {
+	cols := 0
+	for i := range t {
+		if t[i].tok && 0 != t[i].align && 0 == t[i].alignW {
+			cols++
+		}
+	}
+	return cols
+}
+
+// alignLine is an output line held until the widths of its columns are known:
+// cells are the text before each auto width token, the token's value, and
+// the text after the last one
+type alignLine struct {
+	t     *template
+	cells []string
+}
+
+// cells renders t into the text between its auto width tokens and their values
+func (t template) cells(tm tokenMap) []string {
+	cells := []string{}
+	b := strings.Builder{}
+	for i := range t {
+		n := &t[i]
+		b.WriteString(n.lit)
+		if !n.tok {
+			continue
+		}
+		if 0 == n.align || 0 != n.alignW {
+			b.WriteString(n.value(tm))
+			continue
+		}
+		cells = append(cells, b.String(), n.value(tm))
+		b.Reset()
+	}
+	return append(cells, b.String())
+}
+
+// output writes the line of template t, or holds it while the walk aligns
+// its auto width columns (see Options.Align)
+func (w *Walker) output(out *bufio.Writer, t *template) {
+	switch {
+	case w.align:
+		w.lines = append(w.lines, alignLine{t, t.cells(w.tMap)})
+	case w.wraps(t):
+		var b strings.Builder
+		t.render(&b, w.tMap)
+		w.writeLine(out, t, b.String())
+	default:
+		t.output(out, w.tMap, w.eol)
+	}
+}
+
+// wraps reports if the lines of template t are commands given to the
+// -B header's sf_run
+func (w *Walker) wraps(t *template) bool {
+	return w.Harden && (t == &w.tmpl.dir || t == &w.tmpl.file)
+}
+
+// writeLine writes a line of template t, wrapped as t needs
+func (w *Walker) writeLine(out *bufio.Writer, t *template, line string) {
+	switch {
+	case w.wraps(t) && "" != w.Journal:
+		w.runs++
+		line = fmt.Sprintf("sf_run %d %s", w.runs, shQuote(line))
+	case w.wraps(t):
+		line = "sf_run " + shQuote(line)
+	}
+	out.WriteString(line)
+	out.WriteByte(w.eol)
+}
+
+// flushLines writes the held lines, padding each auto width token to the
+// widest value of its column: the same token of the same template
+func (w *Walker) flushLines(out *bufio.Writer) {
+	widths := map[*template][]int{}
+	for _, l := range w.lines {
+		cols := widths[l.t]
+		if nil == cols {
+			cols = make([]int, len(l.cells)/2)
+			widths[l.t] = cols
+		}
+		for c := range cols {
+			if n := utf8.RuneCountInString(l.cells[2*c+1]); n > cols[c] {
+				cols[c] = n
+			}
+		}
+	}
+	for _, l := range w.lines {
+		var b strings.Builder
+		cols, c := widths[l.t], 0
+		for i := range *l.t {
+			n := &(*l.t)[i]
+			if !n.tok || 0 == n.align || 0 != n.alignW {
+				continue
+			}
+			b.WriteString(l.cells[2*c])
+			b.WriteString(alignText(l.cells[2*c+1], n.align, cols[c]))
+			c++
+		}
+		b.WriteString(l.cells[len(l.cells)-1])
+		w.writeLine(out, l.t, b.String())
+	}
+	w.lines = w.lines[:0]
+}
@@ -0,0 +1,271 @@
+package sf
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// IsArchive reports if the named file is an archive that can be walked as a
+// directory: .tar, .tar.gz, .tgz or .zip (in any case)
+func IsArchive(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".tar") || isTarGz(name) || strings.HasSuffix(name, ".zip")
+}
+
+func isTarGz(name string) bool {
+	return strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// openArchive returns the members of the archive 'name' of fsys as an fs.FS;
+// the files of a tar are hashed with 'hashes' as it is read
+func openArchive(fsys fs.FS, name string, hashes []string) (fs.FS, io.Closer, error) {
+	if strings.HasSuffix(strings.ToLower(name), ".zip") {
+		return openZip(fsys, name)
+	}
+	t := &tarFS{fsys: fsys, name: name, gz: isTarGz(strings.ToLower(name)), hashes: hashes}
+	if err := t.load(); nil != err {
+		return nil, nil, err
+	}
+	return t, nopCloser{}, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+func openZip(fsys fs.FS, name string) (fs.FS, io.Closer, error) {
+	f, err := fsys.Open(name)
+	if nil != err {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if nil != err {
+		f.Close()
+		return nil, nil, err
+	}
+	ra, ok := f.(io.ReaderAt)
+	if !ok { // not seekable, read the whole archive
+		data, err := io.ReadAll(f)
+		f.Close()
+		if nil != err {
+			return nil, nil, err
+		}
+		ra, f = bytes.NewReader(data), nil
+	}
+	zr, err := zip.NewReader(ra, fi.Size())
+	if nil != err {
+		if nil != f {
+			f.Close()
+		}
+		return nil, nil, &fs.PathError{Op: "unzip", Path: name, Err: err}
+	}
+	if nil == f {
+		return zr, nopCloser{}, nil
+	}
+	return zr, f, nil
+}
+
+// tarFS is the fs.FS of a (gzipped) tar archive, built from its headers.
+// Member data is not held; opening a file rescans the archive up to it, so
+// any content hashes are taken in the one pass that reads the headers.
+type tarFS struct {
+	fsys   fs.FS
+	name   string
+	gz     bool
+	hashes []string // the content hashes of each file, taken by load
+	nodes  map[string]*tarNode
+}
+
+type tarNode struct {
+	hdr  *tar.Header
+	idx  int       // header index within the archive, -1 for implied dirs
+	kids []string  // sorted member names of a dir
+	sums *fileSums // the content hashes of a file, with tarFS.hashes
+}
+
+// reader returns a tar reader over the archive and the closer of its file
+func (t *tarFS) reader() (*tar.Reader, io.Closer, error) {
+	f, err := t.fsys.Open(t.name)
+	if nil != err {
+		return nil, nil, err
+	}
+	var r io.Reader = f
+	if t.gz {
+		gz, err := gzip.NewReader(f)
+		if nil != err {
+			f.Close()
+			return nil, nil, &fs.PathError{Op: "gunzip", Path: t.name, Err: err}
+		}
+		r = gz
+	}
+	return tar.NewReader(r), f, nil
+}
+
+// memberName cleans a tar header name into an fs.FS path, "" if unusable
+func memberName(name string) string {
+	name = path.Clean("/" + name)[1:]
+	if "" == name || !fs.ValidPath(name) {
+		return ""
+	}
+	return name
+}
+
+func (t *tarFS) load() error {
+	tr, f, err := t.reader()
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+
+	t.nodes = map[string]*tarNode{".": {hdr: &tar.Header{Name: ".", Typeflag: tar.TypeDir, Mode: 0755}, idx: -1}}
+	for idx := 0; ; idx++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if nil != err {
+			return &fs.PathError{Op: "untar", Path: t.name, Err: err}
+		}
+		name := memberName(hdr.Name)
+		if "" == name {
+			continue
+		}
+		t.add(name, hdr, idx)
+		if 0 < len(t.hashes) && !hdr.FileInfo().IsDir() {
+			s := &fileSums{done: make(chan struct{})}
+			s.sums, s.err = hashReader(tr, t.hashes)
+			close(s.done)
+			t.nodes[name].sums = s
+		}
+	}
+	for _, n := range t.nodes {
+		sort.Strings(n.kids)
+	}
+	return nil
+}
+
+// add records a member, creating any parent dirs the archive leaves implied;
+// a member given more than once is known by its last header
+func (t *tarFS) add(name string, hdr *tar.Header, idx int) {
+	if n, ok := t.nodes[name]; ok {
+		if nil != hdr {
+			n.hdr, n.idx = hdr, idx
+		}
+		return
+	}
+	if nil == hdr {
+		hdr = &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}
+	}
+	t.nodes[name] = &tarNode{hdr: hdr, idx: idx}
+	dir := path.Dir(name)
+	t.add(dir, nil, -1)
+	t.nodes[dir].kids = append(t.nodes[dir].kids, path.Base(name))
+}
+
+func (t *tarFS) node(op, name string) (*tarNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	n, ok := t.nodes[name]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return n, nil
+}
+
+func (t *tarFS) Stat(name string) (fs.FileInfo, error) {
+	n, err := t.node("stat", name)
+	if nil != err {
+		return nil, err
+	}
+	return n.hdr.FileInfo(), nil
+}
+
+func (t *tarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := t.node("readdir", name)
+	if nil != err {
+		return nil, err
+	}
+	if !n.hdr.FileInfo().IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	entries := make([]fs.DirEntry, 0, len(n.kids))
+	for _, k := range n.kids {
+		entries = append(entries, fs.FileInfoToDirEntry(t.nodes[path.Join(name, k)].hdr.FileInfo()))
+	}
+	return entries, nil
+}
+
+func (t *tarFS) Open(name string) (fs.File, error) {
+	n, err := t.node("open", name)
+	if nil != err {
+		return nil, err
+	}
+	if n.hdr.FileInfo().IsDir() {
+		entries, _ := t.ReadDir(name)
+		return &tarDir{fi: n.hdr.FileInfo(), entries: entries}, nil
+	}
+
+	tr, f, err := t.reader()
+	if nil != err {
+		return nil, err
+	}
+	for idx := 0; ; idx++ {
+		_, err := tr.Next()
+		if nil != err {
+			f.Close()
+			if err == io.EOF {
+				err = fs.ErrNotExist
+			}
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		if idx == n.idx {
+			return &tarFile{fi: n.hdr.FileInfo(), r: tr, c: f}, nil
+		}
+	}
+}
+
+type tarFile struct {
+	fi fs.FileInfo
+	r  io.Reader
+	c  io.Closer
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) { return f.fi, nil }
+func (f *tarFile) Read(b []byte) (int, error) { return f.r.Read(b) }
+func (f *tarFile) Close() error               { return f.c.Close() }
+
+type tarDir struct {
+	fi      fs.FileInfo
+	entries []fs.DirEntry
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) { return d.fi, nil }
+func (d *tarDir) Close() error               { return nil }
+func (d *tarDir) Read(b []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.fi.Name(), Err: fs.ErrInvalid}
+}
+
+func (d *tarDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if 0 == len(d.entries) {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	entries := d.entries[:count]
+	d.entries = d.entries[count:]
+	return entries, nil
+}
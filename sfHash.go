@@ -0,0 +1,143 @@
+package sf
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"runtime"
+)
+
+// hashFuncs are the content hashes of the %{md5} ... %{crc32} tokens
+var hashFuncs = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+}
+
+// hashAhead is how many files per hashing goroutine are hashed ahead of the
+// file being visited
+const hashAhead = 4
+
+// HashNeeder can be implemented by a Visitor to tell the Walker, once per
+// [dir list] directory, the content hashes ("md5", "sha1", "sha256" or
+// "crc32") it will get with Entry.Hash.  The files are then hashed ahead of
+// the walk, on up to -j (default: a CPU count) goroutines at a time.
+type HashNeeder interface {
+	NeedHashes() []string
+}
+
+// fileSums are the (pending) content hashes of a file
+type fileSums struct {
+	done chan struct{}
+	sums map[string]string
+	err  error
+}
+
+// Hash returns the content hash 'kind' of a file, waiting for it if need be
+func (e *Entry) Hash(kind string) (string, error) {
+	if nil == e.sums {
+		return "", Err_NotHashed
+	}
+	<-e.sums.done
+	if nil != e.sums.err {
+		return "", e.sums.err
+	}
+	sum, ok := e.sums.sums[kind]
+	if !ok {
+		return "", Err_NotHashed
+	}
+	return sum, nil
+}
+
+// hashBatch hashes the files of a dir scan, starting each as the visit
+// of the files nears it
+type hashBatch struct {
+	w     *Walker
+	fsys  fs.FS
+	names []string // fs.FS paths of the files
+	sums  []*fileSums
+}
+
+// hashFiles returns the hashBatch of the files of ds, nil if no hashes
+// are needed
+func (w *Walker) hashFiles(dirPath string, ds *dirScan) *hashBatch {
+	if 0 == len(w.hashes) {
+		return nil
+	}
+	if nil == w.hashSem {
+		jobs := w.Jobs
+		if 1 >= jobs {
+			jobs = runtime.NumCPU()
+		}
+		w.hashSem = make(chan struct{}, jobs)
+	}
+	b := &hashBatch{w: w, fsys: w.fsys}
+	for _, de := range ds.files {
+		b.names = append(b.names, w.fsPath(w.realPath(dirPath, de.Name())))
+	}
+	if t, ok := w.fsys.(*tarFS); ok { // hashed as the archive was read
+		for _, name := range b.names {
+			s := t.nodes[name].sums
+			if nil == s {
+				s = &fileSums{done: make(chan struct{}), err: Err_NotHashed}
+				close(s.done)
+			}
+			b.sums = append(b.sums, s)
+		}
+	}
+	return b
+}
+
+// get returns the hashes of file i, starting those ahead of it
+func (b *hashBatch) get(i int) *fileSums {
+	ahead := i + 1 + hashAhead*cap(b.w.hashSem)
+	for len(b.sums) < ahead && len(b.sums) < len(b.names) {
+		b.sums = append(b.sums, b.start(b.names[len(b.sums)]))
+	}
+	return b.sums[i]
+}
+
+// start hashes the file 'name' once a goroutine slot is free
+func (b *hashBatch) start(name string) *fileSums {
+	s := &fileSums{done: make(chan struct{})}
+	go func(fsys fs.FS, kinds []string, sem chan struct{}) {
+		sem <- struct{}{}
+		s.sums, s.err = hashFile(fsys, name, kinds)
+		<-sem
+		close(s.done)
+	}(b.fsys, b.w.hashes, b.w.hashSem)
+	return s
+}
+
+// hashFile reads the file 'name' once, returning each of its hashes 'kinds'
+func hashFile(fsys fs.FS, name string, kinds []string) (map[string]string, error) {
+	f, err := fsys.Open(name)
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+	return hashReader(f, kinds)
+}
+
+// hashReader reads r to its end, returning each of its hashes 'kinds'
+func hashReader(r io.Reader, kinds []string) (map[string]string, error) {
+	hs, ws := make([]hash.Hash, len(kinds)), make([]io.Writer, len(kinds))
+	for i, k := range kinds {
+		hs[i] = hashFuncs[k]()
+		ws[i] = hs[i]
+	}
+	if _, err := io.Copy(io.MultiWriter(ws...), r); nil != err {
+		return nil, err
+	}
+	sums := map[string]string{}
+	for i, k := range kinds {
+		sums[k] = hex.EncodeToString(hs[i].Sum(nil))
+	}
+	return sums, nil
+}
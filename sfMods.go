@@ -0,0 +1,410 @@
+package sf
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// tmplMod is one step of the modifier pipeline of a %{name|mod|mod} token
+type tmplMod func(string) string
+
+// tokNames are the long names of the %meta tokens, for %{name}; the single
+// character of a token is also accepted as its name
+var tokNames = map[string]string{
+	"origin":   "O",
+	"home":     "H",
+	"root":     "r",
+	"rootpath": "R",
+	"archive":  "A",
+	"fullpath": "P",
+	"path":     "p",
+	"dir":      "D",
+	"dirname":  "d",
+	"size":     "s",
+	"count":    "c",
+	"Count":    "C",
+	"total":    "T",
+	"file":     "f",
+	"fullfile": "F",
+	"name":     "n",
+	"base":     "N",
+	"ext":      "e",
+	"dotext":   "E",
+}
+
+// modFuncs build the %{name|mod:arg:arg} modifiers from their arguments;
+// an empty argument ("mod:") is not the same as none ("mod")
+var modFuncs = map[string]func(args []string) (tmplMod, error){
+	"upper":  noArg(strings.ToUpper),
+	"lower":  noArg(strings.ToLower),
+	"title":  noArg(titleCase),
+	"camel":  noArg(camelCase),
+	"snake":  noArg(func(s string) string { return joinWords(s, "_") }),
+	"kebab":  noArg(func(s string) string { return joinWords(s, "-") }),
+	"cident": noArg(cIdent),
+	"sep": func(args []string) (tmplMod, error) {
+		if err := wantArgs(args, 0, 1); nil != err {
+			return nil, err
+		}
+		if 0 == len(args) {
+			return sepMod("@"), nil
+		}
+		return sepMod(args[0]), nil
+	},
+	"replace": func(args []string) (tmplMod, error) {
+		if err := wantArgs(args, 2, 2); nil != err {
+			return nil, err
+		}
+		if "" == args[0] {
+			return nil, fmt.Errorf("nothing to replace")
+		}
+		return func(s string) string { return strings.ReplaceAll(s, args[0], args[1]) }, nil
+	},
+	"regex": func(args []string) (tmplMod, error) {
+		if err := wantArgs(args, 2, 2); nil != err {
+			return nil, err
+		}
+		rx, err := regexp.Compile(args[0])
+		if nil != err {
+			return nil, err
+		}
+		return func(s string) string { return rx.ReplaceAllString(s, args[1]) }, nil
+	},
+	"slice": func(args []string) (tmplMod, error) {
+		if err := wantArgs(args, 1, 2); nil != err {
+			return nil, err
+		}
+		from, err := intArg(args[0])
+		if nil != err {
+			return nil, err
+		}
+		to, open := 0, 1 == len(args) || "" == args[1]
+		if !open {
+			if to, err = intArg(args[1]); nil != err {
+				return nil, err
+			}
+		}
+		return func(s string) string { return sliceRunes(s, from, to, open) }, nil
+	},
+	"trimprefix": func(args []string) (tmplMod, error) {
+		if err := wantArgs(args, 1, 1); nil != err {
+			return nil, err
+		}
+		return func(s string) string { return strings.TrimPrefix(s, args[0]) }, nil
+	},
+	"trimsuffix": func(args []string) (tmplMod, error) {
+		if err := wantArgs(args, 1, 1); nil != err {
+			return nil, err
+		}
+		return func(s string) string { return strings.TrimSuffix(s, args[0]) }, nil
+	},
+	"trim": func(args []string) (tmplMod, error) {
+		if err := wantArgs(args, 0, 1); nil != err {
+			return nil, err
+		}
+		if 0 == len(args) {
+			return strings.TrimSpace, nil
+		}
+		return func(s string) string { return strings.Trim(s, args[0]) }, nil
+	},
+	"si":  noArg(numMod(func(n int64) string { return humanSize(n, 1000, "") })),
+	"iec": noArg(numMod(func(n int64) string { return humanSize(n, 1024, "i") })),
+	"hex": noArg(numMod(func(n int64) string { return strconv.FormatInt(n, 16) })),
+	"oct": noArg(numMod(func(n int64) string { return strconv.FormatInt(n, 8) })),
+	"thousands": func(args []string) (tmplMod, error) {
+		if err := wantArgs(args, 0, 1); nil != err {
+			return nil, err
+		}
+		sep := ","
+		if 0 < len(args) {
+			sep = args[0]
+		}
+		return numMod(func(n int64) string { return thousands(n, sep) }), nil
+	},
+	"pad": func(args []string) (tmplMod, error) {
+		if err := wantArgs(args, 1, 2); nil != err {
+			return nil, err
+		}
+		width, err := intArg(args[0])
+		if nil != err || 0 > width {
+			return nil, fmt.Errorf("%q is not a width", args[0])
+		}
+		pad := " "
+		if 1 < len(args) {
+			if 1 != utf8.RuneCountInString(args[1]) {
+				return nil, fmt.Errorf("pad %q is not a single character", args[1])
+			}
+			pad = args[1]
+		}
+		return func(s string) string { return padLeft(s, width, pad) }, nil
+	},
+	"maxlen": func(args []string) (tmplMod, error) {
+		if err := wantArgs(args, 1, 1); nil != err {
+			return nil, err
+		}
+		n, err := intArg(args[0])
+		if nil != err || 0 > n {
+			return nil, fmt.Errorf("%q is not a length", args[0])
+		}
+		return func(s string) string { return sliceRunes(s, 0, n, false) }, nil
+	},
+}
+
+// modEscapes are the characters a '\' escapes within %{...}
+const modEscapes = "|}:\\"
+
+// newMod returns the modifier for m, a "name" or "name:arg:arg..." with any
+// escapes of its arguments still in place
+func newMod(m string) (tmplMod, error) {
+	args := splitArgs(m)
+	name := args[0]
+	f, ok := modFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown modifier %q", name)
+	}
+	mod, err := f(args[1:])
+	if nil != err {
+		return nil, fmt.Errorf("modifier %q: %v", name, err)
+	}
+	return mod, nil
+}
+
+// splitArgs splits m at every unescaped ':', removing the escapes
+func splitArgs(m string) []string {
+	args, arg := []string{}, []byte{}
+	for i := 0; i < len(m); i++ {
+		switch c := m[i]; {
+		case '\\' == c && i+1 < len(m) && strings.IndexByte(modEscapes, m[i+1]) >= 0:
+			i++
+			arg = append(arg, m[i])
+		case ':' == c:
+			args, arg = append(args, string(arg)), []byte{}
+		default:
+			arg = append(arg, c)
+		}
+	}
+	return append(args, string(arg))
+}
+
+// unescapeArg removes the escapes of an argument that is not split at ':'
+func unescapeArg(arg string) string {
+	return strings.Join(splitArgs(arg), ":")
+}
+
+// noArg is a modifier that takes no arguments
+func noArg(mod tmplMod) func([]string) (tmplMod, error) {
+	return func(args []string) (tmplMod, error) {
+		if 0 != len(args) {
+			return nil, fmt.Errorf("takes no argument")
+		}
+		return mod, nil
+	}
+}
+
+// wantArgs checks a modifier is given from min to max arguments
+func wantArgs(args []string, min, max int) error {
+	switch {
+	case len(args) < min && min == max:
+		return fmt.Errorf("needs %d argument(s)", min)
+	case len(args) < min:
+		return fmt.Errorf("needs at least %d argument(s)", min)
+	case len(args) > max:
+		return fmt.Errorf("takes at most %d argument(s)", max)
+	}
+	return nil
+}
+
+// intArg parses an integer argument of a modifier
+func intArg(arg string) (int, error) {
+	n, err := strconv.Atoi(arg)
+	if nil != err {
+		return 0, fmt.Errorf("%q is not a number", arg)
+	}
+	return n, nil
+}
+
+// sliceRunes returns the runes from..to of s (to the end if open), negative
+// indexes counting from the end; out of range indexes are clamped
+func sliceRunes(s string, from, to int, open bool) string {
+	r := []rune(s)
+	clamp := func(i int) int {
+		if 0 > i {
+			i += len(r)
+		}
+		if 0 > i {
+			return 0
+		}
+		if i > len(r) {
+			return len(r)
+		}
+		return i
+	}
+	from = clamp(from)
+	if open {
+		to = len(r)
+	} else {
+		to = clamp(to)
+	}
+	if from >= to {
+		return ""
+	}
+	return string(r[from:to])
+}
+
+// splitWords splits s into words at any run of non letters or digits
+// (spaces, dots, dashes, ...) and at case boundaries: "fileName" and
+// "HTTPServer" give "file" "Name" and "HTTP" "Server"
+func splitWords(s string) []string {
+	words, word := []string{}, []rune{}
+	r := []rune(s)
+	for i, c := range r {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			if 0 < len(word) {
+				words, word = append(words, string(word)), []rune{}
+			}
+			continue
+		}
+		if 0 < len(word) && unicode.IsUpper(c) {
+			prev := word[len(word)-1]
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) ||
+				(unicode.IsUpper(prev) && i+1 < len(r) && unicode.IsLower(r[i+1])) {
+				words, word = append(words, string(word)), []rune{}
+			}
+		}
+		word = append(word, c)
+	}
+	if 0 < len(word) {
+		words = append(words, string(word))
+	}
+	return words
+}
+
+// joinWords gives the lower case words of s joined by sep: snake / kebab case
+func joinWords(s, sep string) string {
+	return strings.ToLower(strings.Join(splitWords(s), sep))
+}
+
+// capitalize upper cases the first rune of a word, lower cases the rest
+func capitalize(w string) string {
+	r := []rune(strings.ToLower(w))
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+// titleCase gives TitleCase: every word of s capitalized, then joined
+func titleCase(s string) string {
+	b := strings.Builder{}
+	for _, w := range splitWords(s) {
+		b.WriteString(capitalize(w))
+	}
+	return b.String()
+}
+
+// camelCase gives camelCase: TitleCase with a lower case first word
+func camelCase(s string) string {
+	b := strings.Builder{}
+	for i, w := range splitWords(s) {
+		if 0 == i {
+			b.WriteString(strings.ToLower(w))
+		} else {
+			b.WriteString(capitalize(w))
+		}
+	}
+	return b.String()
+}
+
+// cIdent makes s a valid C (and Go) identifier: every rune other than an
+// ASCII letter, digit or '_' becomes '_', and a leading digit gets a '_'
+func cIdent(s string) string {
+	b := strings.Builder{}
+	for _, c := range s {
+		if '_' == c || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') {
+			b.WriteRune(c)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	id := b.String()
+	if "" == id || ('0' <= id[0] && id[0] <= '9') {
+		id = "_" + id
+	}
+	return id
+}
+
+// numMod applies f to a value that is a whole number, any other value (such
+// as an unknown, empty, one) is left as is
+func numMod(f func(int64) string) tmplMod {
+	return func(s string) string {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if nil != err {
+			return s
+		}
+		return f(n)
+	}
+}
+
+// humanSize gives n in K, M, G, T, P or E units of 'unit' (1000 for SI,
+// 1024 for IEC, with suffix "i"): 512, 1.5k, 23M or 1.2Gi.  One decimal is
+// kept below 10 units.
+func humanSize(n int64, unit int64, suffix string) string {
+	if -unit < n && n < unit {
+		return strconv.FormatInt(n, 10)
+	}
+	u, v, exp := float64(unit), float64(n), 0
+	for ; (v >= u || v <= -u) && exp < 6; exp++ {
+		v /= u
+	}
+	s := ""
+	for {
+		digits := 0
+		if -9.95 < v && v < 9.95 {
+			digits = 1
+		}
+		s = strconv.FormatFloat(v, 'f', digits, 64)
+		r, _ := strconv.ParseFloat(s, 64)
+		if (r < u && r > -u) || 6 == exp {
+			break
+		}
+		v, exp = v/u, exp+1 // rounded up to a whole next unit
+	}
+	prefix := "KMGTPE"[exp-1 : exp]
+	if 1000 == unit && 1 == exp {
+		prefix = "k"
+	}
+	return strings.TrimSuffix(s, ".0") + prefix + suffix
+}
+
+// thousands gives n with sep between each group of three digits
+func thousands(n int64, sep string) string {
+	digits := strconv.FormatInt(n, 10)
+	sign := ""
+	if '-' == digits[0] {
+		sign, digits = "-", digits[1:]
+	}
+	b := strings.Builder{}
+	b.WriteString(sign)
+	for i, c := range digits {
+		if 0 < i && 0 == (len(digits)-i)%3 {
+			b.WriteString(sep)
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// padLeft right aligns s in width runes, filling with pad
+func padLeft(s string, width int, pad string) string {
+	if n := width - utf8.RuneCountInString(s); 0 < n {
+		return strings.Repeat(pad, n) + s
+	}
+	return s
+}
+
+// sepMod replaces the dir separator '/' of a path with sep
+func sepMod(sep string) tmplMod {
+	return func(s string) string { return strings.ReplaceAll(s, "/", sep) }
+}
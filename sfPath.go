@@ -0,0 +1,104 @@
+package sf
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// dirDepth is the depth of a dirpath below the [dir list] directory
+func dirDepth(dir string) int {
+	if "." == dir || "" == dir {
+		return 0
+	}
+	return strings.Count(dir, "/") + 1
+}
+
+// splitPath returns the components of a path, none for "/" or "."
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if "" == p || "." == p {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// partConv makes the %{part:N} conversion: the Nth component of the full
+// path, 1 being the first and -1 the last; empty when out of range
+func partConv(arg string) (tokConv, error) {
+	i, err := strconv.Atoi(arg)
+	if nil != err || 0 == i {
+		return nil, fmt.Errorf("%q is not a component index (1.. or -1..)", arg)
+	}
+	return func(v string, tm tokenMap) string {
+		parts, at := splitPath(v), i
+		if 0 > at {
+			at += len(parts) + 1
+		}
+		if 1 > at || at > len(parts) {
+			return ""
+		}
+		return parts[at-1]
+	}, nil
+}
+
+// upConv makes the %{up:N} conversion: the full path of the dir N levels
+// above the entry, by default 1 (its parent)
+func upConv(arg string) (tokConv, error) {
+	n := 1
+	if "" != arg {
+		var err error
+		if n, err = strconv.Atoi(arg); nil != err || 0 > n {
+			return nil, fmt.Errorf("%q is not a number of levels", arg)
+		}
+	}
+	return func(v string, tm tokenMap) string {
+		for i := 0; i < n; i++ {
+			if "~" == v { // leaving a homified home dir
+				v = tm["H"]
+			}
+			v = path.Dir(v)
+		}
+		return v
+	}, nil
+}
+
+// relPath returns target relative to the dir base, both being clean paths
+// of the same kind (absolute, or relative to the same dir)
+func relPath(base, target string) string {
+	b, t := splitPath(base), splitPath(target)
+	i := 0
+	for i < len(b) && i < len(t) && b[i] == t[i] {
+		i++
+	}
+	rel := []string{}
+	for j := i; j < len(b); j++ {
+		rel = append(rel, "..")
+	}
+	rel = append(rel, t[i:]...)
+	if 0 == len(rel) {
+		return "."
+	}
+	return strings.Join(rel, "/")
+}
+
+// unhomify returns the real path of a (possibly homified) full path
+func (w *Walker) unhomify(p string) string {
+	if w.rooted && ("~" == p || strings.HasPrefix(p, "~/")) {
+		return w.homeDir + p[1:]
+	}
+	return p
+}
+
+// setPaths sets the path arithmetic tokens of e; an archive member has no
+// path on disk for %{rel} to lead to, which is then empty
+func (t *textVisitor) setPaths(e *Entry) {
+	w := t.w
+	w.tMap["depth"] = strconv.Itoa(e.Depth)
+	w.tMap["part"], w.tMap["up"] = e.FullPath, e.FullPath
+	w.tMap["rel"] = ""
+	if "" == e.Archive {
+		w.tMap["rel"] = relPath(w.relTo, w.unhomify(e.FullPath))
+	}
+}
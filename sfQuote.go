@@ -0,0 +1,228 @@
+package sf
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// quoteFunc quotes a token's value for the output's shell
+type quoteFunc func(string) string
+
+// dialects are the quoting dialects of -q; "none" outputs values as is
+var dialects = map[string]quoteFunc{
+	"bash":       bashQuote,
+	"sh":         shQuote,
+	"fish":       fishQuote,
+	"powershell": psQuote,
+	"cmd":        cmdQuote,
+	"make":       makeQuote,
+	"none":       nil,
+}
+
+// defDialect is the dialect without a -q
+const defDialect = "bash"
+
+// pathToksQ are the quoted tokens that hold a path, whose ~/ may expand
+const pathToksQ = "OHrRpPDfF up rel"
+
+// dashToksQ are the quoted tokens made safe from starting with a '-': the
+// paths, and the names that are a path relative to their dir
+const dashToksQ = "OHrRpPDfFnNd up rel"
+
+// tildeDialects expand a leading ~/, which is then kept out of the quotes
+const tildeDialects = " bash sh fish make "
+
+// quoter returns the quoting of a token in the dialect, nil for none.  An
+// empty value stays empty, and with dash a leading '-' gets a "./" in front
+// so it is not taken as an option.
+func quoter(dialect string, isPath, dash bool) quoteFunc {
+	q := dialects[dialect]
+	if nil == q {
+		return nil
+	}
+	tilde := isPath && strings.Contains(tildeDialects, " "+dialect+" ")
+	return func(s string) string {
+		switch {
+		case "" == s:
+			return s
+		case dash && '-' == s[0]:
+			s = "./" + s
+		case tilde && ("~" == s || "~/" == s):
+			return s
+		case tilde && strings.HasPrefix(s, "~/"):
+			return "~/" + q(s[2:])
+		}
+		return q(s)
+	}
+}
+
+// setDialect sets the quoting of the template's path and name tokens, but
+// for those quoted by their own raw, quote or dq modifier
+func (t template) setDialect(dialect string) {
+	for i := range t {
+		if t[i].esc && !t[i].ownQuote {
+			t[i].quote = quoter(dialect, hasTok(pathToksQ, t[i].key), t[i].dashSafe())
+		}
+	}
+}
+
+// dashSafe reports if a leading '-' of the token's value is to be made
+// safe: it is a path or name starting a shell word (not as in "bk_%f")
+func (n *tmplNode) dashSafe() bool {
+	return hasTok(dashToksQ, n.key) && !n.inWord
+}
+
+// setQuote sets the quoting of a token by its raw, quote[:dialect] or dq
+// modifier, whatever the dialect of the output
+func (n *tmplNode) setQuote(how string, args []string) error {
+	if n.ownQuote {
+		return fmt.Errorf("token already quoted")
+	}
+	if "quote" != how && 0 != len(args) {
+		return fmt.Errorf("takes no argument")
+	} else if err := wantArgs(args, 0, 1); nil != err {
+		return err
+	}
+	isPath := hasTok(pathToksQ, n.key)
+	switch how {
+	case "raw":
+		n.quote = nil
+	case "dq":
+		n.quote = dqQuoter(isPath)
+	case "quote":
+		dialect := defDialect
+		if 1 == len(args) {
+			dialect = args[0]
+		}
+		if _, ok := dialects[dialect]; !ok {
+			return fmt.Errorf("unknown quoting dialect %q", dialect)
+		}
+		n.quote = quoter(dialect, isPath, n.dashSafe())
+	}
+	n.ownQuote = true
+	return nil
+}
+
+// dqQuoter escapes a value to go inside a shell's double quotes; the ~ of
+// a homified path becomes $HOME, as a "~" is not expanded
+func dqQuoter(isPath bool) quoteFunc {
+	r := strings.NewReplacer(`\`, `\\`, `$`, `\$`, "`", "\\`", `"`, `\"`)
+	return func(s string) string {
+		if isPath && ("~" == s || strings.HasPrefix(s, "~/")) {
+			return "$HOME" + r.Replace(s[1:])
+		}
+		return r.Replace(s)
+	}
+}
+
+// bareOK reports if s can be output unquoted: it is not empty and only
+// holds ASCII letters and digits, the characters of 'safe', and any non
+// ASCII letters and digits
+func bareOK(s, safe string) bool {
+	if "" == s {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		case r < utf8.RuneSelf && strings.ContainsRune(safe, r):
+		case r >= utf8.RuneSelf && r != utf8.RuneError && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// shSafe are the characters no POSIX shell treats specially
+const shSafe = "@%+=:,./_-"
+
+// shQuote single quotes s for a POSIX shell, each ' in s becoming
+//
+//	'\''
+func shQuote(s string) string {
+	if bareOK(s, shSafe) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// bashQuote single quotes s, or ANSI-C $'...' quotes it if it holds any
+// control or unprintable characters (or is not valid UTF-8)
+func bashQuote(s string) string {
+	plain := utf8.ValidString(s)
+	for _, r := range s {
+		plain = plain && unicode.IsPrint(r)
+	}
+	if plain {
+		return shQuote(s)
+	}
+	b := []byte("$'")
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case utf8.RuneError == r && 1 == size:
+			b = append(b, fmt.Sprintf(`\x%02x`, s[i])...)
+		case '\\' == r || '\'' == r:
+			b = append(b, '\\', byte(r))
+		case '\n' == r:
+			b = append(b, `\n`...)
+		case '\t' == r:
+			b = append(b, `\t`...)
+		case '\r' == r:
+			b = append(b, `\r`...)
+		case !unicode.IsPrint(r): // as bytes, \u depends on the locale
+			for _, c := range []byte(s[i : i+size]) {
+				b = append(b, fmt.Sprintf(`\x%02x`, c)...)
+			}
+		default:
+			b = append(b, s[i:i+size]...)
+		}
+		i += size
+	}
+	return string(append(b, '\''))
+}
+
+// fishQuote single quotes s for fish, escaping any '\' and '
+func fishQuote(s string) string {
+	if bareOK(s, shSafe) {
+		return s
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return "'" + strings.ReplaceAll(s, "'", `\'`) + "'"
+}
+
+// psQuote single quotes s for PowerShell, doubling any ' (including the
+// typographic quotes PowerShell also takes as one)
+func psQuote(s string) string {
+	if bareOK(s, "./_:\\") {
+		return s
+	}
+	var b strings.Builder
+	b.WriteByte('\'')
+	for _, r := range s {
+		if '\'' == r || '‘' == r || '’' == r || '‚' == r || '‛' == r {
+			b.WriteRune(r)
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
+// cmdQuote double quotes s for a cmd.exe batch file, doubling any " and %;
+// cmd has no way to quote a newline
+func cmdQuote(s string) string {
+	if bareOK(s, "./_:\\-") {
+		return s
+	}
+	s = strings.ReplaceAll(s, `%`, `%%`)
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// makeQuote quotes s for the shell of a make recipe, doubling any $
+func makeQuote(s string) string {
+	return strings.ReplaceAll(shQuote(s), "$", "$$")
+}
@@ -0,0 +1,262 @@
+package sf
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/jayacarlson/pth"
+)
+
+// dirScan is the result of reading a directory: its filtered sub-dirs and
+// files in output order and, when the walk needs them, the FileInfo of the
+// dir and of every file.  Errors are kept raw, they are reported when the
+// scan is used.
+type dirScan struct {
+	fi       fs.FileInfo
+	statErr  error
+	readErr  error
+	dirs     []fs.DirEntry
+	files    []fs.DirEntry
+	infos    []fs.FileInfo
+	infoErrs []error
+}
+
+// scanDir reads the directory 'dir' (an fs.FS path) of fsys, de being its
+// entry in the parent dir (nil for a [dir list] directory)
+func (w *Walker) scanDir(fsys fs.FS, dir string, de fs.DirEntry) *dirScan {
+	ds := &dirScan{}
+	// validate latest dir, (test dirs in recursion situation)
+	//  should only possibly get Err_Permission
+	if nil == de {
+		ds.fi, ds.statErr = fs.Stat(fsys, dir)
+	} else if w.needInfo {
+		ds.fi, ds.statErr = de.Info()
+	}
+	if nil != ds.statErr {
+		return ds
+	}
+	entries, err := fs.ReadDir(fsys, dir)
+	if nil != err {
+		ds.readErr = err
+		return ds
+	}
+
+	w.filter(ds, entries)
+	if w.Reverse {
+		for b, e := 0, len(ds.dirs)-1; b < e; b, e = b+1, e-1 {
+			ds.dirs[b], ds.dirs[e] = ds.dirs[e], ds.dirs[b]
+		}
+		for b, e := 0, len(ds.files)-1; b < e; b, e = b+1, e-1 {
+			ds.files[b], ds.files[e] = ds.files[e], ds.files[b]
+		}
+	}
+	w.statFiles(ds)
+	return ds
+}
+
+// filter adds the entries to be walked to the dirs & files of ds
+func (w *Walker) filter(ds *dirScan, entries []fs.DirEntry) {
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if !w.HiddenDirs && len(entry.Name()) > 1 && entry.Name()[0] == '.' {
+				continue
+			}
+			ds.dirs = append(ds.dirs, entry)
+		} else {
+			if !entry.Type().IsRegular() {
+				continue
+			}
+			if !w.HiddenFiles && entry.Name()[0] == '.' {
+				continue
+			}
+			if "" != w.incList || "" != w.excList {
+				_, _, ext := pth.Split(entry.Name())
+				if ext != "" {
+					ext = ext[1:]
+				} else {
+					ext = "-"
+				}
+				if w.IgnoreECase {
+					ext = strings.ToLower(ext)
+				}
+
+				if "" != w.incList && -1 == strings.Index(w.incList, " "+ext+" ") {
+					continue
+				}
+				if "" != w.excList && -1 != strings.Index(w.excList, " "+ext+" ") {
+					continue
+				}
+			}
+			ds.files = append(ds.files, entry)
+		}
+	}
+}
+
+// statFiles gets the FileInfo of every file of ds, if the walk needs them.
+// The info comes with the dir entry: free for archives and in-memory file
+// systems, a single lstat (never a second stat) on the real filesystem.
+func (w *Walker) statFiles(ds *dirScan) {
+	if !w.needInfo {
+		return
+	}
+	ds.infos = make([]fs.FileInfo, len(ds.files))
+	ds.infoErrs = make([]error, len(ds.files))
+	for i, de := range ds.files {
+		ds.infos[i], ds.infoErrs[i] = de.Info()
+	}
+}
+
+// dirInfo returns the FileInfo of 'dir', if the walk needs it or it is a
+// [dir list] directory (de nil) which has to be validated
+func (w *Walker) dirInfo(dir string, de fs.DirEntry) (fs.FileInfo, error) {
+	if nil == de {
+		return fs.Stat(w.fsys, dir)
+	}
+	if w.needInfo {
+		return de.Info()
+	}
+	return nil, nil
+}
+
+// readDir returns the scan of 'dir', from the -j scanner if one is running
+func (w *Walker) readDir(dir string, de fs.DirEntry) *dirScan {
+	if nil != w.scan {
+		return w.scan.get(dir, de)
+	}
+	return w.scanDir(w.fsys, dir, de)
+}
+
+const (
+	scanQueued = iota
+	scanRunning
+	scanClaimed // taken over by the walk before a worker started it
+)
+
+type scanJob struct {
+	dir   string
+	de    fs.DirEntry
+	state int
+	ds    *dirScan
+	done  chan struct{}
+}
+
+// scanner reads directories ahead of a recursive walk on a pool of workers.
+// Jobs are taken newest first, which follows the depth first order of the
+// walk; the walk itself still uses the scans one by one in its own order, so
+// the output is the same as that of a serial walk.
+type scanner struct {
+	w     *Walker
+	fsys  fs.FS
+	mu    sync.Mutex
+	cond  *sync.Cond
+	jobs  []*scanJob // LIFO of queued dirs
+	known map[string]*scanJob
+	ready int // finished scans not yet used by the walk
+	limit int // most finished scans held before the workers wait
+	stop  bool
+	wg    sync.WaitGroup
+}
+
+func newScanner(w *Walker, fsys fs.FS, jobs int) *scanner {
+	s := &scanner{w: w, fsys: fsys, known: map[string]*scanJob{}, limit: 64 * jobs}
+	s.cond = sync.NewCond(&s.mu)
+	s.wg.Add(jobs)
+	for i := 0; i < jobs; i++ {
+		go s.worker()
+	}
+	return s
+}
+
+func (s *scanner) worker() {
+	defer s.wg.Done()
+	for {
+		s.mu.Lock()
+		for !s.stop && (0 == len(s.jobs) || s.ready >= s.limit) {
+			s.cond.Wait()
+		}
+		if s.stop {
+			s.mu.Unlock()
+			return
+		}
+		j := s.jobs[len(s.jobs)-1]
+		s.jobs = s.jobs[:len(s.jobs)-1]
+		if scanQueued != j.state {
+			s.mu.Unlock()
+			continue
+		}
+		j.state = scanRunning
+		s.mu.Unlock()
+
+		j.ds = s.w.scanDir(s.fsys, j.dir, j.de)
+
+		s.mu.Lock()
+		s.ready++
+		s.queue(j.dir, j.ds)
+		s.mu.Unlock()
+		close(j.done)
+	}
+}
+
+// queue adds the sub-dirs of a scanned dir, first sub-dir on top; s.mu held
+func (s *scanner) queue(dir string, ds *dirScan) {
+	for i := len(ds.dirs) - 1; i >= 0; i-- {
+		sub := path.Join(dir, ds.dirs[i].Name())
+		if _, ok := s.known[sub]; !ok {
+			j := &scanJob{dir: sub, de: ds.dirs[i], done: make(chan struct{})}
+			s.known[sub] = j
+			s.jobs = append(s.jobs, j)
+		}
+	}
+	s.cond.Broadcast()
+}
+
+// get returns the scan of 'dir', waiting on a worker already reading it or
+// else reading it right away
+func (s *scanner) get(dir string, de fs.DirEntry) *dirScan {
+	s.mu.Lock()
+	j, ok := s.known[dir]
+	delete(s.known, dir)
+	if ok && scanQueued == j.state {
+		j.state, ok = scanClaimed, false
+	}
+	s.mu.Unlock()
+
+	if ok {
+		<-j.done
+		s.mu.Lock()
+		s.ready--
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		return j.ds
+	}
+	ds := s.w.scanDir(s.fsys, dir, de)
+	s.mu.Lock()
+	s.queue(dir, ds)
+	s.mu.Unlock()
+	return ds
+}
+
+// close stops the workers, any scans not yet used are dropped
+func (s *scanner) close() {
+	s.mu.Lock()
+	s.stop = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// startScan runs a -j scanner over fsys for a recursive walk, the returned
+// func stops it again
+func (w *Walker) startScan(fsys fs.FS) func() {
+	if w.Jobs < 2 || !w.Recursive {
+		return func() {}
+	}
+	prev := w.scan
+	w.scan = newScanner(w, fsys, w.Jobs)
+	return func() {
+		w.scan.close()
+		w.scan = prev
+	}
+}
@@ -0,0 +1,148 @@
+package sf
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// seqDef is the setup of a %{seq:key=value:...} counter
+type seqDef struct {
+	name  string // counters of the same name share their count
+	start int64
+	step  int64
+	pad   int    // zero pad to this many digits
+	reset string // "" never, or per "dir", "ext" or "root"
+	setup bool   // anything besides the name was given
+}
+
+// counter is a named sequence of a walk, advanced once per line using it
+type counter struct {
+	seqDef
+	next map[string]int64 // next value, by dir with reset=dir or extension with reset=ext
+}
+
+// seqKey is the tokenMap key of the counter name
+func seqKey(name string) string {
+	return "seq:" + name
+}
+
+// parseSeq parses the (split) argument of a %{seq:...} token
+func parseSeq(args []string) (seqDef, error) {
+	d := seqDef{start: 1, step: 1}
+	for _, a := range args {
+		if "" == a {
+			continue
+		}
+		k, v, ok := strings.Cut(a, "=")
+		if !ok {
+			return d, fmt.Errorf("%q is not a key=value setting", a)
+		}
+		var err error
+		switch k {
+		case "name":
+			d.name = v
+			continue
+		case "start":
+			d.start, err = strconv.ParseInt(v, 10, 64)
+		case "step":
+			d.step, err = strconv.ParseInt(v, 10, 64)
+		case "pad":
+			d.pad, err = strconv.Atoi(v)
+			if nil == err && (0 > d.pad || 20 < d.pad) {
+				return d, fmt.Errorf("pad must be 0..20")
+			}
+		case "reset":
+			if "dir" != v && "ext" != v && "root" != v {
+				return d, fmt.Errorf("reset must be 'dir', 'ext' or 'root'")
+			}
+			d.reset = v
+		default:
+			return d, fmt.Errorf("unknown setting %q", k)
+		}
+		if nil != err {
+			return d, fmt.Errorf("%q is not a number", v)
+		}
+		d.setup = true
+	}
+	return d, nil
+}
+
+// setCounters registers the counters of the template, any counter being
+// set up by at most one of its tokens, and returns those it uses
+func (w *Walker) setCounters(name string, t template) ([]*counter, error) {
+	used := []*counter{}
+	for i := range t {
+		d := t[i].seq
+		if nil == d {
+			continue
+		}
+		c, ok := w.counters[d.name]
+		switch {
+		case !ok:
+			c = &counter{seqDef: *d}
+			w.counters[d.name] = c
+		case d.setup && c.setup && *d != c.seqDef:
+			return nil, fmt.Errorf("%s: counter %q is set up twice", name, d.name)
+		case d.setup:
+			c.seqDef = *d
+		}
+		seen := false
+		for _, u := range used {
+			seen = seen || u == c
+		}
+		if !seen {
+			used = append(used, c)
+		}
+	}
+	return used, nil
+}
+
+// setSeqs advances the counters of a line of e, setting their tokens
+func (t *textVisitor) setSeqs(used []*counter, e *Entry) {
+	for _, c := range used {
+		dir, ext := e.Dir, e.Ext
+		if e.IsDir { // a dir line counts within its parent
+			dir, ext = path.Dir(e.Dir), ""
+		}
+		dir = path.Join(e.RootPath, dir) // e.Dir is below the [dir list] dir
+		if t.w.IgnoreECase {
+			ext = strings.ToLower(ext)
+		}
+		t.w.tMap[seqKey(c.name)] = c.advance(dir, ext)
+	}
+}
+
+// advance returns the next value of the counter
+func (c *counter) advance(dir, ext string) string {
+	key := ""
+	switch c.reset {
+	case "dir": // a walk comes back to a dir after its subdirs
+		key = dir
+	case "ext":
+		key = ext
+	}
+	if nil == c.next {
+		c.next = map[string]int64{}
+	}
+	v, ok := c.next[key]
+	if !ok {
+		v = c.start
+	}
+	c.next[key] = v + c.step
+	s := strconv.FormatInt(v, 10)
+	if 0 > v {
+		return "-" + padLeft(s[1:], c.pad-1, "0")
+	}
+	return padLeft(s, c.pad, "0")
+}
+
+// resetRoot restarts the reset=root counters, for a new [dir list] dir
+func (w *Walker) resetRoot() {
+	for _, c := range w.counters {
+		if "root" == c.reset {
+			c.next = nil
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package sf
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/fs"
+	"os/user"
+	"strconv"
+	"time"
+)
+
+// sysInfo is the inode data of a file, as far as its filesystem keeps it;
+// unknown numbers are -1.  Only an archive has the user and group names, the
+// ids of a local file are looked up.
+type sysInfo struct {
+	atime, ctime    time.Time
+	uid, gid        int64
+	ino, dev, nlink int64
+	uname, gname    string
+	local           bool
+}
+
+// fileStat returns the inode data of fi, if its filesystem has any
+func fileStat(fi fs.FileInfo) (sysInfo, bool) {
+	if h, ok := fi.Sys().(*tar.Header); ok {
+		return sysInfo{atime: h.AccessTime, ctime: h.ChangeTime,
+			uid: int64(h.Uid), gid: int64(h.Gid), ino: -1, dev: -1, nlink: -1,
+			uname: h.Uname, gname: h.Gname}, true
+	}
+	return sysStat(fi.Sys())
+}
+
+// userName returns the name of the user (or group) id, "" if it has none.
+// Names are looked up once per walker.
+func (w *Walker) userName(id int64, group bool) string {
+	key := fmt.Sprintf("u%d", id)
+	if group {
+		key = fmt.Sprintf("g%d", id)
+	}
+	if name, ok := w.names[key]; ok {
+		return name
+	}
+	name := ""
+	if group {
+		if g, err := user.LookupGroupId(strconv.FormatInt(id, 10)); nil == err {
+			name = g.Name
+		}
+	} else if u, err := user.LookupId(strconv.FormatInt(id, 10)); nil == err {
+		name = u.Username
+	}
+	w.names[key] = name
+	return name
+}
+
+// unixMode gives the permission bits of m in octal, as for chmod: 0755
+func unixMode(m fs.FileMode) string {
+	bits := uint32(m.Perm())
+	if 0 != m&fs.ModeSetuid {
+		bits |= 04000
+	}
+	if 0 != m&fs.ModeSetgid {
+		bits |= 02000
+	}
+	if 0 != m&fs.ModeSticky {
+		bits |= 01000
+	}
+	return fmt.Sprintf("%04o", bits)
+}
+
+// lsMode gives m as 'ls -l' does: -rwxr-xr-x, drwxrwsr-x, ...
+func lsMode(m fs.FileMode) string {
+	b := []byte("----------")
+	switch {
+	case m.IsDir():
+		b[0] = 'd'
+	case 0 != m&fs.ModeSymlink:
+		b[0] = 'l'
+	case 0 != m&fs.ModeNamedPipe:
+		b[0] = 'p'
+	case 0 != m&fs.ModeSocket:
+		b[0] = 's'
+	case 0 != m&fs.ModeCharDevice:
+		b[0] = 'c'
+	case 0 != m&fs.ModeDevice:
+		b[0] = 'b'
+	}
+	for i, c := range "rwxrwxrwx" {
+		if 0 != m&(1<<uint(8-i)) {
+			b[i+1] = byte(c)
+		}
+	}
+	special := func(i int, set bool, c byte) {
+		if !set {
+			return
+		}
+		if 'x' == b[i] {
+			b[i] = c
+		} else {
+			b[i] = c - 'a' + 'A'
+		}
+	}
+	special(3, 0 != m&fs.ModeSetuid, 's')
+	special(6, 0 != m&fs.ModeSetgid, 's')
+	special(9, 0 != m&fs.ModeSticky, 't')
+	return string(b)
+}
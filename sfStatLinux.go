@@ -0,0 +1,26 @@
+//go:build linux
+
+package sf
+
+import (
+	"syscall"
+	"time"
+)
+
+// sysStat returns the inode data of the Sys() of a FileInfo
+func sysStat(sys any) (st sysInfo, ok bool) {
+	s, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	return sysInfo{
+		atime: time.Unix(s.Atim.Unix()),
+		ctime: time.Unix(s.Ctim.Unix()),
+		uid:   int64(s.Uid),
+		gid:   int64(s.Gid),
+		ino:   int64(s.Ino),
+		dev:   int64(s.Dev),
+		nlink: int64(s.Nlink),
+		local: true,
+	}, true
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package sf
+
+// sysStat returns the inode data of the Sys() of a FileInfo, not known on
+// this platform
+func sysStat(sys any) (st sysInfo, ok bool) {
+	return
+}
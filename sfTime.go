@@ -0,0 +1,177 @@
+package sf
+
+import (
+	"fmt"
+	"io/fs"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tokConv turns the stored value of a token into its text, as asked by the
+// argument of a %{name:arg} token
+type tokConv func(v string, tm tokenMap) string
+
+// timeLayout is the format of a time token given without an argument
+const timeLayout = "2006-01-02T15:04:05"
+
+// timeVal is the tokenMap value of a time: its Unix nanoseconds, or "" (not
+// known) for the zero time of a filesystem keeping none (embed.FS, a MapFS
+// file without a ModTime) or any time out of the range of UnixNano
+func timeVal(t time.Time) string {
+	if t.IsZero() || t.Before(minTime) || t.After(maxTime) {
+		return ""
+	}
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// minTime and maxTime are the range of a time in Unix nanoseconds
+var minTime, maxTime = time.Unix(0, math.MinInt64), time.Unix(0, math.MaxInt64)
+
+func parseTimeVal(v string) (time.Time, bool) {
+	ns, err := strconv.ParseInt(v, 10, 64)
+	if nil != err {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+// timeConv returns the conversion of a time token for its argument: a Go
+// layout ("2006-01-02"), a strftime format (any arg with a '%'), "unix" for
+// seconds since the epoch or "age" for the time since then ("3d")
+func timeConv(arg string) (tokConv, error) {
+	var format func(t time.Time, tm tokenMap) string
+	switch {
+	case "" == arg:
+		format = func(t time.Time, _ tokenMap) string { return t.Format(timeLayout) }
+	case "unix" == arg:
+		format = func(t time.Time, _ tokenMap) string { return strconv.FormatInt(t.Unix(), 10) }
+	case "age" == arg:
+		format = func(t time.Time, tm tokenMap) string {
+			now, _ := parseTimeVal(tm["now"])
+			return age(now.Sub(t))
+		}
+	case strings.Contains(arg, "%"):
+		if err := checkStrftime(arg); nil != err {
+			return nil, err
+		}
+		format = func(t time.Time, _ tokenMap) string { return strftime(t, arg) }
+	default:
+		format = func(t time.Time, _ tokenMap) string { return t.Format(arg) }
+	}
+	return func(v string, tm tokenMap) string {
+		t, ok := parseTimeVal(v)
+		if !ok { // not known
+			return ""
+		}
+		return format(t, tm)
+	}, nil
+}
+
+// age gives d in its largest whole unit: 42s, 5m, 3h or 12d
+func age(d time.Duration) string {
+	sign := ""
+	if 0 > d {
+		sign, d = "-", -d
+	}
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%s%ds", sign, d/time.Second)
+	case d < time.Hour:
+		return fmt.Sprintf("%s%dm", sign, d/time.Minute)
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%s%dh", sign, d/time.Hour)
+	}
+	return fmt.Sprintf("%s%dd", sign, d/(24*time.Hour))
+}
+
+// strftimeVerbs are the supported strftime conversions
+const strftimeVerbs = "aAbBdeFHIjmMpsSTyYzZ%"
+
+func checkStrftime(f string) error {
+	for i := 0; i < len(f); i++ {
+		if '%' != f[i] {
+			continue
+		}
+		if i++; i == len(f) {
+			return fmt.Errorf("incomplete strftime conversion at end")
+		}
+		if strings.IndexByte(strftimeVerbs, f[i]) < 0 {
+			return fmt.Errorf("unknown strftime conversion %q", f[i-1:i+1])
+		}
+	}
+	return nil
+}
+
+// strftime formats t as the C strftime would, for the strftimeVerbs
+func strftime(t time.Time, f string) string {
+	b := strings.Builder{}
+	for i := 0; i < len(f); i++ {
+		if '%' != f[i] || i+1 == len(f) {
+			b.WriteByte(f[i])
+			continue
+		}
+		i++
+		switch f[i] {
+		case 'a':
+			b.WriteString(t.Format("Mon"))
+		case 'A':
+			b.WriteString(t.Format("Monday"))
+		case 'b':
+			b.WriteString(t.Format("Jan"))
+		case 'B':
+			b.WriteString(t.Format("January"))
+		case 'd':
+			b.WriteString(t.Format("02"))
+		case 'e':
+			b.WriteString(t.Format("_2"))
+		case 'F':
+			b.WriteString(t.Format("2006-01-02"))
+		case 'H':
+			b.WriteString(t.Format("15"))
+		case 'I':
+			b.WriteString(t.Format("03"))
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 'm':
+			b.WriteString(t.Format("01"))
+		case 'M':
+			b.WriteString(t.Format("04"))
+		case 'p':
+			b.WriteString(t.Format("PM"))
+		case 's':
+			b.WriteString(strconv.FormatInt(t.Unix(), 10))
+		case 'S':
+			b.WriteString(t.Format("05"))
+		case 'T':
+			b.WriteString(t.Format("15:04:05"))
+		case 'y':
+			b.WriteString(t.Format("06"))
+		case 'Y':
+			b.WriteString(t.Format("2006"))
+		case 'z':
+			b.WriteString(t.Format("-0700"))
+		case 'Z':
+			b.WriteString(t.Format("MST"))
+		default:
+			b.WriteByte(f[i])
+		}
+	}
+	return b.String()
+}
+
+// fileTimes returns the modification, access and change time of fi; what
+// the filesystem does not keep is given as the modification time
+func fileTimes(fi fs.FileInfo) (mtime, atime, ctime time.Time) {
+	mtime, atime, ctime = fi.ModTime(), fi.ModTime(), fi.ModTime()
+	if st, ok := fileStat(fi); ok {
+		if !st.atime.IsZero() {
+			atime = st.atime
+		}
+		if !st.ctime.IsZero() {
+			ctime = st.ctime
+		}
+	}
+	return
+}
@@ -0,0 +1,358 @@
+package sf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jayacarlson/dbg"
+)
+
+// tmplNode is a literal chunk followed by an optional %meta token
+type tmplNode struct {
+	lit      string
+	tok      bool      // a token follows lit
+	key      string    // the tokenMap key of the token
+	conv     tokConv   // turns the value into text, for a token with an argument
+	mods     []tmplMod // modifier pipeline applied to the token's value
+	esc      bool      // a path or name, quoted by the dialect of the output
+	quote    quoteFunc // quotes the (modified) value, nil for none
+	ownQuote bool      // quote set by the token's raw, quote or dq modifier
+	inWord   bool      // the token follows other text of its shell word
+	align    byte      // '<' left or '>' right align the output value
+	alignW   int       // width to align to, 0 for the widest value of the column
+	pad      byte      // '0' or ' ' padding of a width token
+	width    int       // 2..9 width of a padded token
+	seq      *seqDef   // the counter of a %{seq:...} token
+}
+
+// template is a compiled output string, parsed once and rendered per line
+type template []tmplNode
+
+// The %meta tokens each output string can use; every one of them is set
+// afresh for each line the string outputs
+const (
+	leadToks  = "%OH"                                    // -L
+	tailToks  = leadToks + "T"                           // -T
+	aLeadToks = leadToks + "rRA"                         // -l
+	aTailToks = aLeadToks + "CT"                         // -t
+	dirToks   = aLeadToks + "PpDdscCT"                   // -d
+	sDirToks  = aLeadToks + "PpDdsT"                     // -d with -S, no dir counts
+	fileToks  = dirToks + "fFnNeE"                       // -f
+	argToks   = "123456789"                              // the config 'head' and 'tail' blocks
+	bashToks  = "%aO" + journalTok                       // the BASH header
+	allToks   = fileToks + argToks + "a" + longToks      // known to any output string
+	padToks   = "csCT" + numToks                         // can take a %02..%09 / % 2..% 9 width
+	caseToks  = "rpdDfnNeE"                              // can take a 'u' or 'l' case modifier
+	sepToks   = "pDf"                                    // can take the '@' dir separator modifier
+	escToks   = "OHrRApPdDfFnNeE user group part up rel" // paths and names, quoted
+)
+
+// The tokens only known by their long name (%{name}), each listed after a
+// space so they can follow the characters of the tokens above
+const (
+	nowTok     = " now"                                           // any output string
+	timeToks   = " mtime atime ctime"                             // -d and -f
+	statToks   = " mode perms uid gid user group inode dev nlink" // -d and -f
+	entryToks  = timeToks + statToks                              // -d and -f
+	seqTok     = " seq"                                           // -d and -f, a counter
+	pathToks   = " depth part up rel"                             // -d and -f
+	hashToks   = " md5 sha1 sha256 crc32"                         // -f, file content hashes
+	journalTok = " journal"                                       // the BASH header, the -J file
+	clockToks  = timeToks + nowTok                                // take a time format
+	numToks    = " uid gid inode dev nlink seq depth"             // numbers
+	longToks   = entryToks + nowTok + seqTok + pathToks + hashToks + journalTok
+)
+
+// hasTok reports if key is one of the tokens toks; a key holding a space
+// would match several names
+func hasTok(toks, key string) bool {
+	chars, names, _ := strings.Cut(toks, " ")
+	if 1 == utf8.RuneCountInString(key) {
+		return strings.Contains(chars, key)
+	}
+	return "" != key && !strings.Contains(key, " ") && strings.Contains(" "+names+" ", " "+key+" ")
+}
+
+// TmplError is an error in an output string, found when it is compiled
+type TmplError struct {
+	Name string // the flag (-f, -d, ...) or config block of the string
+	Col  int    // 1 based column (in runes) of the error
+	Msg  string
+}
+
+func (e *TmplError) Error() string {
+	return fmt.Sprintf("%s: column %d: %s", e.Name, e.Col, e.Msg)
+}
+
+// compileTmpl parses src into a template, name being the flag or config
+// block it came from.  Only the tokens in toks can be used.  With 'escapes'
+// the literal text can hold \n \t \0 \\ \xNN and \uNNNN escapes (as for the
+// -L -l -d -f -t -T strings); any other backslash is kept as is.
+func compileTmpl(name, src string, escapes bool, toks string) (template, error) {
+	t := template{}
+	lit := []byte{}
+	for i := 0; i < len(src); {
+		c := src[i]
+		if '\\' == c && escapes {
+			s, size, msg := unescape(src[i:])
+			if "" != msg {
+				return nil, tmplErr(name, src, i, msg)
+			}
+			lit = append(lit, s...)
+			i += size
+			continue
+		}
+		if '%' != c {
+			lit = append(lit, c)
+			i++
+			continue
+		}
+		if i+1 < len(src) && '\n' == src[i+1] { // not a token
+			lit = append(lit, "%\n"...)
+			i += 2
+			continue
+		}
+		last, _ := utf8.DecodeLastRune(lit) // RuneError for none
+		inWord := 0 < len(t) && 0 == len(lit) || 0 < len(lit) && !unicode.IsSpace(last)
+		n, size, at, msg := parseToken(src[i+1:], toks, inWord)
+		if "" != msg {
+			return nil, tmplErr(name, src, i+at, msg)
+		}
+		n.lit, lit = string(lit), lit[:0]
+		t = append(t, n)
+		i += 1 + size
+	}
+	if 0 < len(lit) {
+		t = append(t, tmplNode{lit: string(lit)})
+	}
+	t.setDialect(defDialect)
+	return t, nil
+}
+
+func tmplErr(name, src string, at int, msg string) error {
+	return &TmplError{Name: name, Col: utf8.RuneCountInString(src[:at]) + 1, Msg: msg}
+}
+
+// parseToken parses the token following a '%', returning its node (without
+// the literal) and length, or a message on why it is not valid and where
+// (an offset from the '%')
+func parseToken(s, toks string, inWord bool) (tmplNode, int, int, string) {
+	n := tmplNode{tok: true, inWord: inWord}
+	if "" == s {
+		return n, 0, 0, "incomplete token at end"
+	}
+	if '{' == s[0] {
+		return parseLongToken(s, toks, inWord)
+	}
+	size, mod := 1, byte(0)
+	switch c := s[0]; {
+	case ('0' == c || ' ' == c) && 1 < len(s) && '1' < s[1] && s[1] <= '9': // 2..9 digits
+		n.pad, n.width, size = c, int(s[1]-'0'), 3
+	case '@' == c || 'u' == c || 'l' == c:
+		mod, size = c, 2
+	}
+	if 0 != n.width && 2 < len(s) && '{' == s[2] { // a padded %{name}
+		ln, lsize, at, msg := parseLongToken(s[2:], toks, inWord)
+		if "" != msg {
+			return n, 0, at + 2, msg
+		}
+		if nil == ln.seq && !hasTok(padToks, ln.key) {
+			return n, 0, 0, fmt.Sprintf("cannot set a width for %q", "%"+s[:2+lsize])
+		}
+		ln.pad, ln.width = n.pad, n.width
+		return ln, 2 + lsize, 0, ""
+	}
+	if len(s) < size {
+		return n, 0, 0, "incomplete token at end"
+	}
+	r, rsize := utf8.DecodeRuneInString(s[size-1:])
+	n.key, size = string(r), size-1+rsize
+	tok := fmt.Sprintf("%q", "%"+s[:size])
+
+	switch {
+	case 0 != n.width && !hasTok(padToks, n.key):
+		return n, 0, 0, "cannot set a width for " + tok
+	case '@' == mod && !strings.Contains(sepToks, n.key):
+		return n, 0, 0, "cannot replace the dir separator of " + tok
+	case ('u' == mod || 'l' == mod) && !strings.Contains(caseToks, n.key):
+		return n, 0, 0, "cannot change case of " + tok
+	case !hasTok(allToks, n.key) || utf8.RuneError == r:
+		return n, 0, 0, "unknown token " + tok
+	case !hasTok(toks, n.key):
+		return n, 0, 0, "token " + tok + " cannot be used here"
+	}
+	n.esc = hasTok(escToks, n.key)
+	switch mod {
+	case 'u':
+		n.mods = []tmplMod{strings.ToUpper}
+	case 'l':
+		n.mods = []tmplMod{strings.ToLower}
+	case '@':
+		n.mods = []tmplMod{sepMod("@")}
+	}
+	return n, size, 0, ""
+}
+
+// parseLongToken parses a %{name|mod|mod:arg:arg} token, s starting at its
+// '{'.  Within the braces a '\' escapes a following '|', '}', ':' or '\'.
+func parseLongToken(s, toks string, inWord bool) (tmplNode, int, int, string) {
+	n := tmplNode{tok: true, inWord: inWord}
+	parts, offs := []string{}, []int{}
+	start, size := 1, 0
+	for i := 1; i < len(s) && 0 == size; i++ {
+		switch c := s[i]; {
+		case '\\' == c && i+1 < len(s) && strings.IndexByte(modEscapes, s[i+1]) >= 0:
+			i++
+		case '|' == c || '}' == c:
+			parts, offs = append(parts, s[start:i]), append(offs, 1+start)
+			start = i + 1
+			if '}' == c {
+				size = i + 1
+			}
+		}
+	}
+	if 0 == size {
+		return n, 0, 0, "missing '}' of %{"
+	}
+
+	name, arg, hasArg := strings.Cut(parts[0], ":")
+	tok := fmt.Sprintf("%q", "%{"+name+"}")
+	n.key = name
+	if k, ok := tokNames[name]; ok {
+		n.key = k
+	}
+	switch {
+	case !hasTok(allToks, n.key):
+		return n, 0, offs[0], "unknown token " + tok
+	case !hasTok(toks, n.key):
+		return n, 0, offs[0], "token " + tok + " cannot be used here"
+	case hasArg && !hasTok(clockToks+seqTok+" part up", n.key):
+		return n, 0, offs[0], "token " + tok + " takes no argument"
+	}
+	var err error
+	switch {
+	case "seq" == n.key:
+		var d seqDef
+		if d, err = parseSeq(splitArgs(arg)); nil == err {
+			n.key, n.seq = seqKey(d.name), &d
+		}
+	case hasTok(clockToks, n.key):
+		n.conv, err = timeConv(unescapeArg(arg))
+	case "part" == n.key:
+		n.conv, err = partConv(unescapeArg(arg))
+	case "up" == n.key:
+		n.conv, err = upConv(unescapeArg(arg))
+	}
+	if nil != err {
+		return n, 0, offs[0], fmt.Sprintf("token %s: %v", tok, err)
+	}
+	n.esc = hasTok(escToks, n.key)
+	for i, m := range parts[1:] {
+		args := splitArgs(m)
+		switch args[0] {
+		case "left", "right":
+			err = n.setAlign(args[0], args[1:])
+		case "raw", "quote", "dq":
+			err = n.setQuote(args[0], args[1:])
+		default:
+			var mod tmplMod
+			if mod, err = newMod(m); nil != err {
+				return n, 0, offs[i+1], err.Error()
+			}
+			n.mods = append(n.mods, mod)
+		}
+		if nil != err {
+			return n, 0, offs[i+1], fmt.Sprintf("modifier %q: %v", args[0], err)
+		}
+	}
+	return n, size, 0, ""
+}
+
+// unescape decodes the backslash escape at the start of s, returning its
+// value and length, or a message on why it is not valid
+func unescape(s string) (string, int, string) {
+	if 2 > len(s) {
+		return s, len(s), ""
+	}
+	switch s[1] {
+	case 'n':
+		return "\n", 2, ""
+	case 't':
+		return "\t", 2, ""
+	case '0':
+		return "\x00", 2, ""
+	case '\\':
+		return "\\", 2, ""
+	case 'x', 'u':
+		digits := 2
+		if 'u' == s[1] {
+			digits = 4
+		}
+		if len(s) < 2+digits {
+			return "", 0, fmt.Sprintf("incomplete \\%c escape", s[1])
+		}
+		v, err := strconv.ParseUint(s[2:2+digits], 16, 32)
+		if nil != err || ('u' == s[1] && !utf8.ValidRune(rune(v))) {
+			return "", 0, fmt.Sprintf("invalid \\%c escape %q", s[1], s[:2+digits])
+		}
+		if 'x' == s[1] {
+			return string([]byte{byte(v)}), 2 + digits, ""
+		}
+		return string(rune(v)), 2 + digits, ""
+	}
+	return s[:1], 1, "" // not an escape, keep the backslash
+}
+
+// render writes the template, its tokens replaced from tm, in a single pass
+func (t template) render(out io.StringWriter, tm tokenMap) {
+	for i := range t {
+		n := &t[i]
+		out.WriteString(n.lit)
+		if n.tok {
+			out.WriteString(n.value(tm))
+		}
+	}
+}
+
+// value returns the output text of the token of n
+func (n *tmplNode) value(tm tokenMap) string {
+	vl, ok := tm[n.key]
+	dbg.ChkTruX(ok, "Unset replacement token: %%%s", n.key)
+	if nil != n.conv {
+		vl = n.conv(vl, tm)
+	}
+	for _, m := range n.mods {
+		vl = m(vl)
+	}
+	if nil != n.quote {
+		vl = n.quote(vl)
+	}
+	if flen := n.width - len(vl); flen > 0 {
+		vl = strings.Repeat(string(n.pad), flen) + vl
+	}
+	if 0 != n.alignW {
+		vl = alignText(vl, n.align, n.alignW)
+	}
+	return vl
+}
+
+// uses reports if the template uses any of the %meta tokens toks
+func (t template) uses(toks string) bool {
+	for i := range t {
+		if t[i].tok && hasTok(toks, t[i].key) {
+			return true
+		}
+	}
+	return false
+}
+
+// output renders the template as a line of output, ended by eol
+func (t template) output(out *bufio.Writer, tm tokenMap, eol byte) {
+	t.render(out, tm)
+	out.WriteByte(eol)
+}
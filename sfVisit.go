@@ -0,0 +1,265 @@
+package sf
+
+import (
+	"bufio"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/jayacarlson/dbg"
+)
+
+// Entry describes the [dir list] root, directory or file being visited.  It
+// carries the same data the %meta tokens expose, without any shell escaping.
+type Entry struct {
+	Root     string // r  [dir list] directory as given (homified by default)
+	RootPath string // R  full dirpath of the [dir list] directory
+	Path     string // p  dirpath from [dir list] directory on down
+	FullPath string // P / F  full dirpath or filepath (homified by default)
+	Dir      string // D  dirpath below [dir list] directory
+	Name     string // d / n  directory name, or filename and extension
+	Base     string // N  filename without any extension
+	Ext      string // E  extension, including the '.'
+	File     string // f  filepath from [dir list] directory on down
+	Archive  string // A  [dir list] archive as given, "" unless walking an archive
+	Depth    int    // depth  below the [dir list] directory, as find counts it (root 0)
+
+	IsDir   bool // a directory (or [dir list] root) rather than a file
+	Shallow bool // sub-directory listed, but not entered, by a non-recursive walk
+
+	Size      int64 // s  file/dir size
+	Files     int64 // c  file count inside the dir (dirs only, -1 if not read: -S or Shallow)
+	Dirs      int64 // C  dir count inside the dir (dirs only, -1 if not read: -S or Shallow)
+	Count     int64 // c  file count inside the dir (files only)
+	RootCount int64 // C  file count inside the [dir list] dir (files and root end)
+	Total     int64 // T  total file count over all [dir list] dirs
+
+	de      fs.DirEntry // the entry as read from its parent dir
+	info    fs.FileInfo
+	infoErr error
+	sums    *fileSums // content hashes, if the visitor needs them
+}
+
+// Info returns the fs.FileInfo of the directory or file.  When the walk did
+// not need it (see FileInfoNeeder) it is read on first use, then kept.
+func (e *Entry) Info() (fs.FileInfo, error) {
+	if nil == e.info && nil == e.infoErr && nil != e.de {
+		e.info, e.infoErr = e.de.Info()
+	}
+	return e.info, e.infoErr
+}
+
+// Visitor receives the entries of a walk in output order.  Returning an
+// error from any callback stops the walk and is returned by the Walker.
+//
+// OnError is called for every root, directory or file that cannot be read;
+// returning nil skips the entry and continues the walk.
+type Visitor interface {
+	OnRootStart(e *Entry) error
+	OnDirEnter(e *Entry) error
+	OnFile(e *Entry) error
+	OnDirLeave(e *Entry) error
+	OnRootEnd(e *Entry) error
+	OnError(e *Entry, err error) error
+}
+
+// FileInfoNeeder can be implemented by a Visitor to tell the Walker, once per
+// [dir list] directory, if it needs the Size of the directories and files.
+// When it does not, entries are never stat'ed; Entry.Info still works.
+type FileInfoNeeder interface {
+	NeedFileInfo() bool
+}
+
+// textVisitor renders the -l / -d / -f / -t templates of its Walker
+type textVisitor struct {
+	w   *Walker
+	out *bufio.Writer
+}
+
+// infoToks are the %meta tokens taken from the FileInfo of an entry
+const infoToks = "s" + entryToks
+
+func (t *textVisitor) NeedFileInfo() bool {
+	return t.w.tmpl.dir.uses(infoToks) || t.w.tmpl.file.uses(infoToks)
+}
+
+func (t *textVisitor) NeedHashes() []string {
+	kinds := []string{}
+	for _, k := range strings.Fields(hashToks) {
+		if t.w.tmpl.file.uses(" " + k) {
+			kinds = append(kinds, k)
+		}
+	}
+	return kinds
+}
+
+// setHashes sets the content hash tokens of the file e
+func (t *textVisitor) setHashes(e *Entry) error {
+	for _, k := range t.w.hashes {
+		sum, err := e.Hash(k)
+		if nil != err {
+			return err
+		}
+		t.w.tMap[k] = sum
+	}
+	return nil
+}
+
+// setRoot sets the [dir list] tokens, used by every line of the walk
+func (t *textVisitor) setRoot(e *Entry) {
+	t.w.tMap["R"] = e.RootPath
+	t.w.tMap["r"] = e.Root
+	t.w.tMap["A"] = e.Archive
+}
+
+// setCount sets tok to n, empty when the count is not known
+func (t *textVisitor) setCount(tok string, n int64) {
+	if 0 > n {
+		t.w.tMap[tok] = ""
+	} else {
+		t.w.tMap[tok] = strconv.FormatInt(n, 10)
+	}
+}
+
+// setTimes sets the time tokens from the FileInfo of e, empty if not read
+func (t *textVisitor) setTimes(e *Entry) {
+	if nil == e.info {
+		t.w.tMap["mtime"], t.w.tMap["atime"], t.w.tMap["ctime"] = "", "", ""
+		return
+	}
+	mtime, atime, ctime := fileTimes(e.info)
+	t.w.tMap["mtime"] = timeVal(mtime)
+	t.w.tMap["atime"] = timeVal(atime)
+	t.w.tMap["ctime"] = timeVal(ctime)
+}
+
+// setStat sets the mode, owner and inode tokens from the FileInfo of e,
+// empty for what is not known; only done if a template uses them
+func (t *textVisitor) setStat(e *Entry) {
+	w := t.w
+	if !w.useStat {
+		return
+	}
+	for _, k := range strings.Fields(statToks) {
+		w.tMap[k] = ""
+	}
+	if nil == e.info {
+		return
+	}
+	w.tMap["mode"], w.tMap["perms"] = unixMode(e.info.Mode()), lsMode(e.info.Mode())
+	st, ok := fileStat(e.info)
+	if !ok {
+		return
+	}
+	t.setCount("uid", st.uid)
+	t.setCount("gid", st.gid)
+	t.setCount("inode", st.ino)
+	t.setCount("dev", st.dev)
+	t.setCount("nlink", st.nlink)
+	if st.local {
+		w.tMap["user"], w.tMap["group"] = w.userName(st.uid, false), w.userName(st.gid, true)
+	} else {
+		w.tMap["user"], w.tMap["group"] = st.uname, st.gname
+	}
+}
+
+func (t *textVisitor) OnRootStart(e *Entry) error {
+	w := t.w
+	t.setRoot(e)
+	w.resetRoot()
+	if w.ALeadOutput != "" {
+		w.output(t.out, &w.tmpl.aLead)
+	}
+	return nil
+}
+
+func (t *textVisitor) OnDirEnter(e *Entry) error {
+	w := t.w
+	if "dir" == w.Align { // each dir aligned on its own
+		w.flushLines(t.out)
+	}
+	if w.DirOutput == "" {
+		return nil
+	}
+	t.setRoot(e)
+	w.tMap["P"] = e.FullPath
+	w.tMap["p"] = e.Path
+	w.tMap["D"] = e.Dir
+	w.tMap["d"] = e.Name
+	w.tMap["s"] = strconv.FormatInt(e.Size, 10)
+	t.setCount("c", e.Files)
+	t.setCount("C", e.Dirs)
+	w.tMap["T"] = strconv.FormatInt(e.Total, 10)
+	t.setTimes(e)
+	t.setStat(e)
+	t.setPaths(e)
+	t.setSeqs(w.seqs.dir, e)
+	w.output(t.out, &w.tmpl.dir)
+	return nil
+}
+
+func (t *textVisitor) OnFile(e *Entry) error {
+	w := t.w
+	if w.FileOutput == "" {
+		return nil
+	}
+	if err := t.setHashes(e); nil != err {
+		if err = chkErr(err); Err_NotExist != err {
+			dbg.Warning("Failed to hash file: `%s`", e.FullPath)
+		}
+		return t.OnError(e, err)
+	}
+	ext := e.Ext
+	t.setRoot(e)
+	w.tMap["P"] = path.Dir(e.FullPath)
+	w.tMap["p"] = e.Path
+	w.tMap["D"] = e.Dir
+	w.tMap["d"] = path.Base(e.Dir)
+	w.tMap["n"] = e.Name
+	w.tMap["N"] = e.Base
+	w.tMap["E"] = ext
+	if ext != "" {
+		ext = ext[1:]
+	}
+	w.tMap["e"] = ext
+	w.tMap["c"] = strconv.FormatInt(e.Count, 10)
+	w.tMap["C"] = strconv.FormatInt(e.RootCount, 10)
+	w.tMap["T"] = strconv.FormatInt(e.Total, 10)
+	w.tMap["s"] = strconv.FormatInt(e.Size, 10)
+	t.setTimes(e)
+	t.setStat(e)
+	w.tMap["F"] = e.FullPath
+	w.tMap["f"] = e.File
+	t.setPaths(e)
+	t.setSeqs(w.seqs.file, e)
+	w.output(t.out, &w.tmpl.file)
+	return nil
+}
+
+func (t *textVisitor) OnDirLeave(e *Entry) error {
+	return nil
+}
+
+func (t *textVisitor) OnRootEnd(e *Entry) error {
+	w := t.w
+	if w.ATailOutput != "" {
+		t.setRoot(e)
+		w.tMap["C"] = strconv.FormatInt(e.RootCount, 10)
+		w.tMap["T"] = strconv.FormatInt(e.Total, 10)
+		w.output(t.out, &w.tmpl.aTail)
+	}
+	return nil
+}
+
+// OnError skips missing or restricted entries below the [dir list] root,
+// anything else (or any root failure) ends the walk
+func (t *textVisitor) OnError(e *Entry, err error) error {
+	if e.IsDir && e.Dir == "." {
+		return err
+	}
+	if err == Err_NotExist || err == Err_Permission {
+		return nil
+	}
+	return err
+}
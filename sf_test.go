@@ -1,13 +1,30 @@
-package main
+package sf
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"crypto/md5"
+	"crypto/sha1"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
+	"unicode/utf8"
 
 	"github.com/jayacarlson/dbg"
 	"github.com/jayacarlson/tst"
@@ -50,6 +67,7 @@ var (
 	showTestData bool
 	showTestSums bool
 	outTo        bufRW
+	opts         Options
 )
 
 func init() {
@@ -59,17 +77,7 @@ func init() {
 }
 
 func initFunc() {
-	fileOutput, dirOutput = "%f", ""
-	aLeadOutput, aTailOutput = "", ""
-	// leadOutput, tailOutput not testable as that happens in 'main'
-	ignoreECase = false
-	hiddenFiles = false
-	hiddenDirs = false
-	recursive = false
-	reverse = false
-	incList = ""
-	excList = ""
-	totalCount = 0
+	opts = Options{FileOutput: "%f"}
 }
 
 func finiFunc() {
@@ -77,160 +85,1555 @@ func finiFunc() {
 }
 
 func setIELists(ignore bool, include, exclude string) {
-	ignoreECase = ignore
-	if include != "" {
-		if ignoreECase {
-			include = strings.ToLower(include)
-		}
-		incList = " " + include + " "
-	}
-	if exclude != "" {
-		if ignoreECase {
-			exclude = strings.ToLower(exclude)
-		}
-		excList = " " + exclude + " "
-	}
+	opts.IgnoreECase = ignore
+	opts.Include = include
+	opts.Exclude = exclude
+}
+
+func processDir(outTo io.Writer, curDir string) {
+	w, err := NewWalker(opts)
+	dbg.ChkTruX(nil == err, "NewWalker: %v", err)
+	w.ProcessDir(outTo, curDir)
 }
 
 // ========================================================================= //
 //	Can't use %P, %R or %F as they are unique to each user's dir structure
 
 func testDirsNonRecursive() (string, string, bool) {
-	fileOutput = ""
-	dirOutput = "r: %r   p: %p   D: %D   d: %d"
+	opts.FileOutput = ""
+	opts.DirOutput = "r: %r   p: %p   D: %D   d: %d"
 	processDir(outTo, "testdata")
 	sum := outTo.MD5Sum()
-	return dbg.IAm(), "", sum != "dd32871c2c927dad0a655ac8f4155b1a"
+	return dbg.IAm(), "", sum != "fbfb46a18297b322e1b972673ae6b76f"
 }
 
 func testDirsRecursive() (string, string, bool) {
-	recursive = true
-	fileOutput = ""
-	dirOutput = "r: %r   p: %p   D: %D   d: %d"
+	opts.Recursive = true
+	opts.FileOutput = ""
+	opts.DirOutput = "r: %r   p: %p   D: %D   d: %d"
 	processDir(outTo, "testdata")
 	sum := outTo.MD5Sum()
 	return dbg.IAm(), "", sum != "546f6d03637df3138ceb857cf0ee44b1"
 }
 
 func testDirsReverseRecursive() (string, string, bool) {
-	reverse = true
-	recursive = true
-	fileOutput = ""
-	dirOutput = "r: %r   p: %p   D: %D   d: %d"
+	opts.Reverse = true
+	opts.Recursive = true
+	opts.FileOutput = ""
+	opts.DirOutput = "r: %r   p: %p   D: %D   d: %d"
 	processDir(outTo, "testdata")
 	sum := outTo.MD5Sum()
 	return dbg.IAm(), "", sum != "de20c3392d493f80247b422e5bdbe34a"
 }
 
 func testDirsAlterCase() (string, string, bool) {
-	recursive = true
-	fileOutput = ""
-	dirOutput = " r: %r   p: %p   D: %D   d: %d\nlr: %lr  lp: %lp  lD: %lD  ld: %ld\nur: %ur  up: %up  uD: %uD  ud: %ud"
+	opts.Recursive = true
+	opts.FileOutput = ""
+	opts.DirOutput = " r: %r   p: %p   D: %D   d: %d\nlr: %lr  lp: %lp  lD: %lD  ld: %ld\nur: %ur  up: %up  uD: %uD  ud: %ud"
 	processDir(outTo, "testdata")
 	sum := outTo.MD5Sum()
 	return dbg.IAm(), "", sum != "648c63c6bd4cc350519d734e6978c618"
 }
 
 func testDirsBashOutput() (string, string, bool) {
-	recursive = true
-	fileOutput = ""
+	opts.Recursive = true
+	opts.FileOutput = ""
 	// bashHeader processed by 'main', but we can get argDir lead/tail
-	aLeadOutput = "# Going to run 'someTool' on dirs in '%r'"
-	aTailOutput = "# Done with '%r'"
-	dirOutput = "someTool %p someOtherDir/%D"
+	opts.ALeadOutput = "# Going to run 'someTool' on dirs in '%r'"
+	opts.ATailOutput = "# Done with '%r'"
+	opts.DirOutput = "someTool %p someOtherDir/%D"
 	processDir(outTo, "testdata")
 	sum := outTo.MD5Sum()
 	return dbg.IAm(), "", sum != "6ae1c460dea9c5de52d7ec8b3924a0bd"
 }
 
 func testFilesNonRecursive() (string, string, bool) {
-	fileOutput = "f: %f  n: %n  N: %N  e: %e  E: %E  c: %c  C: %C"
+	opts.FileOutput = "f: %f  n: %n  N: %N  e: %e  E: %E  c: %c  C: %C"
 	processDir(outTo, "testdata")
 	sum := outTo.MD5Sum()
 	return dbg.IAm(), "", sum != "7d639395050a94b5aa53229b0b16289b"
 }
 
 func testFilesRecursive() (string, string, bool) {
-	recursive = true
-	fileOutput = "f: %f  n: %n  N: %N  e: %e  E: %E  c: %c  C: %C"
+	opts.Recursive = true
+	opts.FileOutput = "f: %f  n: %n  N: %N  e: %e  E: %E  c: %c  C: %C"
 	processDir(outTo, "testdata")
 	sum := outTo.MD5Sum()
 	return dbg.IAm(), "", sum != "58ec0905a533b1f2fb525c2147d92313"
 }
 
 func testFilesReverseRecursive() (string, string, bool) {
-	reverse = true
-	recursive = true
-	fileOutput = "f: %f  n: %n  N: %N  e: %e  E: %E  c: %c  C: %C"
+	opts.Reverse = true
+	opts.Recursive = true
+	opts.FileOutput = "f: %f  n: %n  N: %N  e: %e  E: %E  c: %c  C: %C"
 	processDir(outTo, "testdata")
 	sum := outTo.MD5Sum()
 	return dbg.IAm(), "", sum != "076668796119c36c488f1d2d44f2fceb"
 }
 
 func testFilesNoExt() (string, string, bool) {
-	recursive = true
+	opts.Recursive = true
 	setIELists(false, "-", "")
-	fileOutput = "f: %f  n: %n  N: %N  e: %e  E: %E  c: %c  C: %C"
+	opts.FileOutput = "f: %f  n: %n  N: %N  e: %e  E: %E  c: %c  C: %C"
 	processDir(outTo, "testdata")
 	sum := outTo.MD5Sum()
 	return dbg.IAm(), "", sum != "b86e1dd278bfde0201c0f6ed256a2ff6"
 }
 
 func testFilesIncExt() (string, string, bool) {
-	recursive = true
+	opts.Recursive = true
 	setIELists(false, "ext ex1 ex2", "")
-	fileOutput = "f: %f  n: %n  N: %N  e: %e  E: %E  c: %c  C: %C"
+	opts.FileOutput = "f: %f  n: %n  N: %N  e: %e  E: %E  c: %c  C: %C"
 	processDir(outTo, "testdata")
 	sum := outTo.MD5Sum()
 	return dbg.IAm(), "", sum != "2f5f9c5c394fa05a4263c70e55337ad6"
 }
 
 func testFilesExcExt() (string, string, bool) {
-	recursive = true
+	opts.Recursive = true
 	setIELists(false, "", "ext ex1 ex2")
-	fileOutput = "f: %f  n: %n  N: %N  e: %e  E: %E  c: %c  C: %C"
+	opts.FileOutput = "f: %f  n: %n  N: %N  e: %e  E: %E  c: %c  C: %C"
 	processDir(outTo, "testdata")
 	sum := outTo.MD5Sum()
 	return dbg.IAm(), "", sum != "afe7e561ba3a61beb191f940a5eb5848"
 }
 
 func testFilesIncExtIgCase() (string, string, bool) {
-	recursive = true
+	opts.Recursive = true
 	setIELists(true, "ext -", "")
-	fileOutput = "f: %f  n: %n  N: %N  e: %e  E: %E  c: %c  C: %C"
+	opts.FileOutput = "f: %f  n: %n  N: %N  e: %e  E: %E  c: %c  C: %C"
 	processDir(outTo, "testdata")
 	sum := outTo.MD5Sum()
 	return dbg.IAm(), "", sum != "b681cc0fa83baf30f7565d80e459df3f"
 }
 
 func testFilesExcExtIgCase() (string, string, bool) {
-	recursive = true
+	opts.Recursive = true
 	setIELists(true, "", "ext -")
-	fileOutput = "f: %f  n: %n  N: %N  e: %e  E: %E  c: %c  C: %C"
+	opts.FileOutput = "f: %f  n: %n  N: %N  e: %e  E: %E  c: %c  C: %C"
 	processDir(outTo, "testdata")
 	sum := outTo.MD5Sum()
 	return dbg.IAm(), "", sum != "4b89da8ee6ac1cded5119fb4231411c6"
 }
 
 func testFilesAlterCase() (string, string, bool) {
-	recursive = true
-	fileOutput = " f: %f   n: %n   N: %N   e: %e   E: %E  c: %c  C: %C\nuf: %uf  un: %un  uN: %uN  ue: %ue  uE: %uE\nlf: %lf  ln: %ln  lN: %lN  le: %le  lE: %lE"
+	opts.Recursive = true
+	opts.FileOutput = " f: %f   n: %n   N: %N   e: %e   E: %E  c: %c  C: %C\nuf: %uf  un: %un  uN: %uN  ue: %ue  uE: %uE\nlf: %lf  ln: %ln  lN: %lN  le: %le  lE: %lE"
 	processDir(outTo, "testdata")
 	sum := outTo.MD5Sum()
 	return dbg.IAm(), "", sum != "6da7b87df46dd0b4afe8dce9c93315d2"
 }
 
 func testFilesBashOutput() (string, string, bool) {
-	recursive = true
+	opts.Recursive = true
 	// bashHeader processed by 'main', but we can get argDir lead/tail
-	aLeadOutput = "# Going to run 'someTool' on files in '%r'"
-	aTailOutput = "# Done with '%r'"
-	fileOutput = "someTool %f someOtherDir/%D/x-%n-x"
+	opts.ALeadOutput = "# Going to run 'someTool' on files in '%r'"
+	opts.ATailOutput = "# Done with '%r'"
+	opts.FileOutput = "someTool %f someOtherDir/%D/x-%n-x"
 	processDir(outTo, "testdata")
 	sum := outTo.MD5Sum()
 	return dbg.IAm(), "", sum != "539d5a154f00b639f5234c882d9e5940"
 }
 
+func testRunLeadTail() (string, string, bool) {
+	opts.Recursive = true
+	opts.LeadOutput = "# lead %%"
+	opts.TailOutput = "# total %T"
+	w, _ := NewWalker(opts)
+	w.Run(outTo, []string{"testdata/Dir1", "testdata/Dir2"})
+	out := outTo.buffer.String()
+	return dbg.IAm(), "", !strings.HasPrefix(out, "# lead %\n") ||
+		!strings.HasSuffix(out, "# total 18\n")
+}
+
+// testHeadTailArgs checks a %1 ... %9 not given is empty, not unset
+func testHeadTailArgs() (string, string, bool) {
+	outTo.Reset()
+	opts = Options{FS: fstest.MapFS{"top/a": {}}, Head: "h %1|%3", Tail: "t %9", FileOutput: "%n"}
+	opts.Args[0] = "one"
+	w, err := NewWalker(opts)
+	if nil != err {
+		return dbg.IAm(), err.Error(), true
+	}
+	w.Run(outTo, []string{"top"})
+	got := outTo.buffer.String()
+	return dbg.IAm(), got, "h one|\na\nt \n" != got
+}
+
+func testWalkersIndependent() (string, string, bool) {
+	opts.Recursive = true
+	opts.FileOutput = "%f %C %T"
+	var alone, one, two bytes.Buffer
+	w, _ := NewWalker(opts)
+	w.ProcessDir(&alone, "testdata")
+
+	w1, _ := NewWalker(opts)
+	w2, _ := NewWalker(opts)
+	w2.ProcessDir(&two, "testdata/Dir1")
+	w1.ProcessDir(&one, "testdata")
+	w2.ProcessDir(&two, "testdata/Dir2")
+	return dbg.IAm(), "", alone.String() != one.String()
+}
+
+type recVisitor struct {
+	calls []string
+}
+
+func (r *recVisitor) OnRootStart(e *Entry) error {
+	r.calls = append(r.calls, "root+ "+e.Root)
+	return nil
+}
+
+func (r *recVisitor) OnDirEnter(e *Entry) error {
+	r.calls = append(r.calls, fmt.Sprintf("dir+ %s %d/%d", e.Dir, e.Files, e.Dirs))
+	return nil
+}
+
+func (r *recVisitor) OnFile(e *Entry) error {
+	r.calls = append(r.calls, fmt.Sprintf("file %s %s|%s %d/%d/%d", e.File, e.Base, e.Ext, e.Count, e.RootCount, e.Total))
+	return nil
+}
+
+func (r *recVisitor) OnDirLeave(e *Entry) error {
+	r.calls = append(r.calls, "dir- "+e.Dir)
+	return nil
+}
+
+func (r *recVisitor) OnRootEnd(e *Entry) error {
+	r.calls = append(r.calls, fmt.Sprintf("root- %s %d", e.Root, e.RootCount))
+	return nil
+}
+
+func (r *recVisitor) OnError(e *Entry, err error) error {
+	r.calls = append(r.calls, "error "+e.Dir)
+	return err
+}
+
+func testVisitorOrder() (string, string, bool) {
+	opts.Recursive = true
+	r := &recVisitor{}
+	w, _ := NewWalker(opts)
+	err := w.Visit(r, []string{"testdata/Dir2", "testdata/none"})
+	expect := []string{
+		"root+ testdata/Dir2",
+		"dir+ . 3/1",
+		"file testdata/Dir2/File2.ext File2|.ext 1/1/1",
+		"file testdata/Dir2/file.Ex2 file|.Ex2 2/2/2",
+		"file testdata/Dir2/file1.ext file1|.ext 3/3/3",
+		"dir+ sub2 3/0",
+		"file testdata/Dir2/sub2/File.ex2 File|.ex2 1/4/4",
+		"file testdata/Dir2/sub2/file.Ex1 file|.Ex1 2/5/5",
+		"file testdata/Dir2/sub2/file.Ext file|.Ext 3/6/6",
+		"dir- sub2",
+		"dir- .",
+		"root- testdata/Dir2 6",
+		"root+ testdata/none",
+		"error .",
+		"root- testdata/none 0",
+	}
+	return dbg.IAm(), "", err != Err_NotExist ||
+		strings.Join(r.calls, "\n") != strings.Join(expect, "\n")
+}
+
+// lockedFS refuses to read any directory named 'locked'
+type lockedFS struct {
+	fstest.MapFS
+}
+
+func (l lockedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if path.Base(name) == "locked" {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrPermission}
+	}
+	return l.MapFS.ReadDir(name)
+}
+
+func testFSOddNames() (string, string, bool) {
+	opts.Recursive = true
+	opts.FS = fstest.MapFS{
+		"top/a dir/it's (1).txt": {},
+		"top/a dir/x\"y.ext":     {},
+		"top/a dir/.hidden":      {},
+		"top/plain":              {Data: []byte("12345")},
+	}
+	opts.FileOutput = "%f %N %e %s %F"
+	processDir(outTo, "top")
+	expect := "top/plain plain  5 top/plain\n" +
+		`'top/a dir/it'\''s (1).txt' 'it'\''s (1)' txt 0 'top/a dir/it'\''s (1).txt'` + "\n" +
+		`'top/a dir/x"y.ext' 'x"y' ext 0 'top/a dir/x"y.ext'` + "\n"
+	return dbg.IAm(), "", outTo.buffer.String() != expect
+}
+
+func testTimeTokens() (string, string, bool) {
+	mod := time.Date(2021, 3, 4, 5, 6, 7, 0, time.Local)
+	old := time.Now().Add(-3*24*time.Hour - time.Hour)
+	opts.FS = fstest.MapFS{
+		"top":       {Mode: fs.ModeDir, ModTime: mod},
+		"top/a.txt": {ModTime: mod},
+		"top/b.txt": {ModTime: old},
+	}
+	opts.LeadOutput = "# %{now:2006}"
+	opts.DirOutput = "# %{mtime:unix}"
+	opts.FileOutput = "%f %{mtime} %{mtime:2006-01-02} %{mtime:%Y/%m/%d %H:%M %j} %{ctime:unix} %{mtime:age}"
+	w, err := NewWalker(opts)
+	if nil != err {
+		return dbg.IAm(), err.Error(), true
+	}
+	w.Run(outTo, []string{"top"})
+	expect := fmt.Sprintf("# %d\n# %d\n", time.Now().Year(), mod.Unix()) +
+		fmt.Sprintf("top/a.txt 2021-03-04T05:06:07 2021-03-04 2021/03/04 05:06 063 %d %dd\n",
+			mod.Unix(), int(time.Since(mod).Hours()/24)) +
+		fmt.Sprintf("top/b.txt %s %s %s %d 3d\n", old.Format(timeLayout), old.Format("2006-01-02"),
+			strftime(old, "%Y/%m/%d %H:%M %j"), old.Unix())
+	if got := outTo.buffer.String(); got != expect {
+		return dbg.IAm(), got, true
+	}
+	outTo.Reset() // no ModTime is a time not known
+	w, _ = NewWalker(Options{FS: fstest.MapFS{"top/c": {}}, FileOutput: "%n [%{mtime}] [%{mtime:age}] [%{atime:unix}]"})
+	w.Run(outTo, []string{"top"})
+	if got := outTo.buffer.String(); got != "c [] [] []\n" {
+		return dbg.IAm(), got, true
+	}
+	for _, tc := range []struct {
+		o   Options
+		err string
+	}{
+		{Options{FileOutput: "%{f:x}"}, `-f: column 3: token "%{f}" takes no argument`},
+		{Options{FileOutput: "%{mtime:%Q}"}, `-f: column 3: token "%{mtime}": unknown strftime conversion "%Q"`},
+		{Options{LeadOutput: "%{mtime}"}, `-L: column 3: token "%{mtime}" cannot be used here`},
+	} {
+		if _, err := NewWalker(tc.o); fmt.Sprint(err) != tc.err {
+			return dbg.IAm(), fmt.Sprintf("%+v: %v", tc.o, err), true
+		}
+	}
+	return dbg.IAm(), "", false
+}
+
+func testStatTokens() (string, string, bool) {
+	var tbuf bytes.Buffer
+	tw := tar.NewWriter(&tbuf)
+	tw.WriteHeader(&tar.Header{Name: "x.sh", Mode: 04755, Uid: 1234, Gid: 99, Uname: "jo doe", Gname: "staff"})
+	tw.Close()
+	opts.FS = fstest.MapFS{
+		"top/a":     {Mode: 0640},
+		"top/b":     {Mode: 02775 | fs.ModeSetgid},
+		"top/c":     {Mode: 0700 | fs.ModeSticky},
+		"top/x.tar": {Data: tbuf.Bytes()},
+	}
+	opts.IgnoreECase = true
+	opts.Exclude = "tar"
+	opts.FileOutput = "%n %{mode} %{perms} [%{uid} %{gid} %{user} %{group} %{inode} %{nlink}]"
+	w, _ := NewWalker(opts)
+	w.Run(outTo, []string{"top"})
+	opts.Exclude = ""
+	w, _ = NewWalker(opts)
+	w.Run(outTo, []string{"top/x.tar"})
+	expect := "a 0640 -rw-r----- [     ]\n" +
+		"b 2775 -rwxrwsr-x [     ]\n" +
+		"c 1700 -rwx-----T [     ]\n" +
+		"x.sh 4755 -rwsr-xr-x [1234 99 'jo doe' staff  ]\n"
+	if got := outTo.buffer.String(); got != expect {
+		return dbg.IAm(), got, true
+	}
+	if "linux" != runtime.GOOS {
+		return dbg.IAm(), "", false
+	}
+
+	dir, err := os.MkdirTemp("", "sf")
+	if nil != err {
+		return dbg.IAm(), err.Error(), true
+	}
+	defer os.RemoveAll(dir)
+	os.WriteFile(dir+"/f", nil, 0600)
+	os.Link(dir+"/f", dir+"/g")
+	outTo.Reset()
+	opts = Options{FileOutput: "%n %{perms} %{uid} %{nlink} %{user}", DontHomify: true}
+	w, _ = NewWalker(opts)
+	w.Run(outTo, []string{dir})
+	u, _ := user.Current()
+	expect = fmt.Sprintf("f -rw------- %d 2 %s\ng -rw------- %d 2 %s\n", os.Getuid(), u.Username, os.Getuid(), u.Username)
+	return dbg.IAm(), outTo.buffer.String(), outTo.buffer.String() != expect
+}
+
+func testFSPermission() (string, string, bool) {
+	opts.Recursive = true
+	opts.FS = lockedFS{fstest.MapFS{
+		"d/f1":          {},
+		"d/locked/f2":   {},
+		"d/open/f3":     {},
+		"d/open/locked": {Mode: fs.ModeDir},
+	}}
+	opts.DirOutput = "# %D"
+	processDir(outTo, "d")
+	expect := "# .\nd/f1\n# open\nd/open/f3\n"
+	return dbg.IAm(), "", outTo.buffer.String() != expect
+}
+
+// archives builds a .tgz and a .zip holding the same members
+func archives() fstest.MapFS {
+	members := []struct{ name, data string }{
+		{"top/a.txt", "hello"},
+		{"top/sub/b.txt", "hi"},
+		{"top/sub/.c", ""},
+	}
+	var tgz, zbuf bytes.Buffer
+	gz := gzip.NewWriter(&tgz)
+	tw := tar.NewWriter(gz)
+	zw := zip.NewWriter(&zbuf)
+	for _, m := range members {
+		tw.WriteHeader(&tar.Header{Name: m.name, Mode: 0644, Size: int64(len(m.data))})
+		tw.Write([]byte(m.data))
+		f, _ := zw.Create(m.name)
+		f.Write([]byte(m.data))
+	}
+	tw.Close()
+	gz.Close()
+	zw.Close()
+	return fstest.MapFS{
+		"build.tgz": {Data: tgz.Bytes()},
+		"build.zip": {Data: zbuf.Bytes()},
+	}
+}
+
+func testArchives() (string, string, bool) {
+	opts.Recursive = true
+	opts.FS = archives()
+	opts.ALeadOutput = "# %r"
+	opts.DirOutput = "mkdir -p out/%D"
+	opts.FileOutput = "%A %f %D %n %s"
+	w, _ := NewWalker(opts)
+	w.Run(outTo, []string{"build.tgz", "build.zip"})
+	expect := ""
+	for _, a := range []string{"build.tgz", "build.zip"} {
+		expect += "# " + a + "\nmkdir -p out/.\nmkdir -p out/top\n" +
+			a + " top/a.txt top a.txt 5\nmkdir -p out/top/sub\n" +
+			a + " top/sub/b.txt top/sub b.txt 2\n"
+	}
+	if got := outTo.buffer.String(); got != expect {
+		return dbg.IAm(), got, true
+	}
+
+	outTo.Reset() // a dir with an archive's name is walked as a dir
+	w, _ = NewWalker(Options{FS: fstest.MapFS{"backup.tar/a": {}, "v1.zip/b": {}}, FileOutput: "%A|%f"})
+	w.Run(outTo, []string{"backup.tar", "v1.zip"})
+	got := outTo.buffer.String()
+	return dbg.IAm(), got, "|backup.tar/a\n|v1.zip/b\n" != got
+}
+
+func testTarMemberData() (string, string, bool) {
+	afs, _, err := openArchive(archives(), "build.tgz", nil)
+	if nil != err {
+		return dbg.IAm(), err.Error(), true
+	}
+	if err = fstest.TestFS(afs, "top/a.txt", "top/sub/b.txt", "top/sub/.c"); nil != err {
+		return dbg.IAm(), err.Error(), true
+	}
+	data, err := fs.ReadFile(afs, "top/sub/b.txt")
+	return dbg.IAm(), "", nil != err || "hi" != string(data)
+}
+
+// bigTree builds a MapFS of 'width' dirs per level, 'depth' levels deep
+func bigTree(width, depth int) fstest.MapFS {
+	m := fstest.MapFS{}
+	var fill func(dir string, level int)
+	fill = func(dir string, level int) {
+		for i := 0; i < width; i++ {
+			m[fmt.Sprintf("%s/f%d.txt", dir, i)] = &fstest.MapFile{Data: make([]byte, i)}
+			if level < depth {
+				fill(fmt.Sprintf("%s/d%d", dir, i), level+1)
+			}
+		}
+	}
+	fill("tree", 1)
+	return m
+}
+
+func testJobsMatchSerial() (string, string, bool) {
+	tree := bigTree(5, 4)
+	for _, reverse := range []bool{false, true} {
+		for _, fsys := range []fs.FS{nil, tree} {
+			dir := "testdata"
+			if nil != fsys {
+				dir = "tree"
+			}
+			var serial, parallel bytes.Buffer
+			o := Options{Recursive: true, Reverse: reverse, FS: fsys,
+				DirOutput: "# %D %c %C %T", FileOutput: "%f %s %c %C %T"}
+			w, _ := NewWalker(o)
+			w.ProcessDir(&serial, dir)
+			o.Jobs = 8
+			w, _ = NewWalker(o)
+			w.ProcessDir(&parallel, dir)
+			if serial.String() != parallel.String() || 0 == serial.Len() {
+				return dbg.IAm(), dir, true
+			}
+		}
+	}
+	return dbg.IAm(), "", false
+}
+
+func sortedLines(s string) string {
+	l := strings.Split(s, "\n")
+	sort.Strings(l)
+	return strings.Join(l, "\n")
+}
+
+func testStreamMatchesSorted() (string, string, bool) {
+	tree := bigTree(4, 3)
+	for _, fsys := range []fs.FS{nil, tree} {
+		dir := "testdata"
+		if nil != fsys {
+			dir = "tree"
+		}
+		var sorted, stream bytes.Buffer
+		o := Options{Recursive: true, FS: fsys, DirOutput: "# %D %s", FileOutput: "%f %s %T"}
+		w, _ := NewWalker(o)
+		w.ProcessDir(&sorted, dir)
+		o.Stream = true
+		w, _ = NewWalker(o)
+		w.ProcessDir(&stream, dir)
+		// T follows the order, drop it
+		strip := regexp.MustCompile(" [0-9]+\n")
+		if sortedLines(strip.ReplaceAllString(sorted.String(), "\n")) !=
+			sortedLines(strip.ReplaceAllString(stream.String(), "\n")) {
+			return dbg.IAm(), dir, true
+		}
+	}
+	_, err := NewWalker(Options{Stream: true, Reverse: true})
+	return dbg.IAm(), "", Err_Stream != err
+}
+
+func testDeepTree() (string, string, bool) {
+	deep := strings.Repeat("d/", 2000) + "f"
+	opts.Recursive = true
+	opts.FS = fstest.MapFS{deep: {}}
+	opts.FileOutput = "%f"
+	processDir(outTo, "d")
+	return dbg.IAm(), "", outTo.buffer.String() != deep+"\n"
+}
+
+// countFS counts the Stat calls and the dir entry Info calls made on it
+type countFS struct {
+	fstest.MapFS
+	stats, infos *int
+}
+
+type countEntry struct {
+	fs.DirEntry
+	infos *int
+}
+
+func (c countEntry) Info() (fs.FileInfo, error) {
+	*c.infos++
+	return c.DirEntry.Info()
+}
+
+func (c countFS) Stat(name string) (fs.FileInfo, error) {
+	*c.stats++
+	return c.MapFS.Stat(name)
+}
+
+func (c countFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := c.MapFS.ReadDir(name)
+	for i := range entries {
+		entries[i] = countEntry{entries[i], c.infos}
+	}
+	return entries, err
+}
+
+func testSingleStat() (string, string, bool) {
+	tree := bigTree(3, 3) // 39 files in 13 dirs
+	for _, tc := range []struct {
+		dirOut, fileOut string
+		jobs            int
+		stats, infos    int
+	}{
+		{"", "%f", 0, 1, 0},
+		{"", "%f %s", 0, 1, 39 + 12},
+		{"%p %s", "%f", 0, 1, 39 + 12},
+		{"", "%f %04s", 8, 1, 39 + 12},
+		{"", "%{f} %{size}", 0, 1, 39 + 12},
+	} {
+		var stats, infos int
+		var out bytes.Buffer
+		w, _ := NewWalker(Options{Recursive: true, FS: countFS{tree, &stats, &infos},
+			DirOutput: tc.dirOut, FileOutput: tc.fileOut, Jobs: tc.jobs})
+		w.ProcessDir(&out, "tree")
+		if stats != tc.stats || infos != tc.infos {
+			return dbg.IAm(), fmt.Sprintf("%q: %d stats %d infos", tc.fileOut, stats, infos), true
+		}
+	}
+	return dbg.IAm(), "", false
+}
+
+// legacyReplace is the recursive regexp engine the compiled templates
+// replaced, kept as the reference for them
+var legacyRex = regexp.MustCompile("((?s).*?)%(.)((?s).*)")
+
+func legacyReplace(t tokenMap, src string) string {
+	if x := legacyRex.FindStringSubmatch(src); x != nil {
+		vl := ""
+		if (x[2] == "0" || x[2] == " ") && (x[3][0] > '1' && x[3][0] <= '9') { // 2..9 digits
+			key := x[3][1:2]
+			vl = t[key]
+			flen := int(x[3][0]-'0') - len(vl)
+			x[3] = x[3][2:]
+			if flen > 0 {
+				vl = strings.Repeat(x[2], flen) + vl
+			}
+		} else if x[2] == "@" && (x[3][0] == 'p' || x[3][0] == 'D' || x[3][0] == 'f') {
+			x[2] = x[3][0:1]
+			x[3] = x[3][1:]
+			vl = strings.ReplaceAll(t[x[2]], "/", "@")
+		} else {
+			lc, uc := x[2] == "l", x[2] == "u"
+			if uc || lc {
+				x[2] = x[3][0:1]
+				x[3] = x[3][1:]
+			}
+			vl = t[x[2]]
+			if uc {
+				vl = strings.ToUpper(vl)
+			} else if lc {
+				vl = strings.ToLower(vl)
+			}
+		}
+		return x[1] + vl + legacyReplace(t, x[3])
+	}
+	return src
+}
+
+var benchTmpls = []string{
+	"%f",
+	"f: %f  n: %n  N: %N  e: %e  E: %E  c: %c  C: %C",
+	" f: %f   n: %n   N: %N   e: %e   E: %E  c: %05c  C: % 3C\nuf: %uf  un: %un  uN: %uN  ue: %ue  uE: %uE\nlf: %lf  ln: %ln  lN: %lN  le: %le  lE: %lE",
+	"convert %f -resize 50%% -quality 90 out/%@f.%le  # %T" + strings.Repeat(" %n", 20),
+	"100%% done\\n%\nend",
+}
+
+func benchMap() tokenMap {
+	tm := tokenMap{"%": "%", "c": "7", "C": "42", "T": "1234", "s": "4096"}
+	tm["f"] = "Dir 1/Sub1/File Name.Ext"
+	tm["n"] = "File Name.Ext"
+	tm["N"] = "File Name"
+	tm["e"] = "Ext"
+	tm["E"] = ".Ext"
+	return tm
+}
+
+// legacyMap is the map of the legacy engine, quoted as its tokens were set
+func legacyMap(tm tokenMap) tokenMap {
+	lm := tokenMap{}
+	for k, v := range tm {
+		if hasTok(escToks, k) {
+			v = quoter(defDialect, hasTok(pathToksQ, k), hasTok(dashToksQ, k))(v)
+		}
+		lm[k] = v
+	}
+	return lm
+}
+
+func testCompiledMatchesLegacy() (string, string, bool) {
+	tmap := benchMap()
+	for _, src := range benchTmpls {
+		var b bytes.Buffer
+		out := bufio.NewWriter(&b)
+		t, _ := compileTmpl("-f", src, true, fileToks)
+		t.output(out, tmap, '\n')
+		out.Flush()
+		legacy := strings.ReplaceAll(legacyReplace(legacyMap(tmap), src), "\\n", "\n") + "\n"
+		if b.String() != legacy {
+			return dbg.IAm(), src, true
+		}
+	}
+	return dbg.IAm(), "", false
+}
+
+func testTmplErrors() (string, string, bool) {
+	for _, tc := range []struct{ src, err string }{
+		{"%f", ""},
+		{"mv %f %uq", `-f: column 7: cannot change case of "%uq"`},
+		{"echo %f > %q.txt", `-f: column 11: unknown token "%q"`},
+		{"%f %09n", `-f: column 4: cannot set a width for "%09n"`},
+		{"%f %@n", `-f: column 4: cannot replace the dir separator of "%@n"`},
+		{"%1", `-f: column 1: token "%1" cannot be used here`},
+		{"é %", `-f: column 3: incomplete token at end`},
+		{"%f %u", `-f: column 4: incomplete token at end`},
+		{"%f %0", `-f: column 4: unknown token "%0"`},
+		{"%f %@", `-f: column 4: incomplete token at end`},
+		{`%f\x4`, `-f: column 3: incomplete \x escape`},
+		{`%f\xzz`, `-f: column 3: invalid \x escape "\\xzz"`},
+		{`%f\ud800`, `-f: column 3: invalid \u escape "\\ud800"`},
+	} {
+		_, err := compileTmpl("-f", tc.src, true, fileToks)
+		if msg := fmt.Sprint(err); (nil == err && "" != tc.err) || (nil != err && msg != tc.err) {
+			return dbg.IAm(), fmt.Sprintf("%q: %v", tc.src, err), true
+		}
+	}
+	for _, tc := range []struct {
+		o   Options
+		err string
+	}{
+		{Options{LeadOutput: "# %O %f"}, `-L: column 6: token "%f" cannot be used here`},
+		{Options{ALeadOutput: "# %r %T"}, `-l: column 6: token "%T" cannot be used here`},
+		{Options{ATailOutput: "# %r %C %T %s"}, `-t: column 12: token "%s" cannot be used here`},
+		{Options{DirOutput: "# %p %n"}, `-d: column 6: token "%n" cannot be used here`},
+		{Options{DirOutput: "# %p %c", Stream: true}, `-d: column 6: token "%c" cannot be used here`},
+		{Options{Head: "%1 %T"}, `head: column 4: token "%T" cannot be used here`},
+		{Options{Tail: "%1 %T %a"}, `tail: column 7: token "%a" cannot be used here`},
+		{Options{FileOutput: "%{mtime atime}"}, `-f: column 3: unknown token "%{mtime atime}"`},
+		{Options{DirOutput: "%{uid gid}"}, `-d: column 3: unknown token "%{uid gid}"`},
+	} {
+		if _, err := NewWalker(tc.o); fmt.Sprint(err) != tc.err {
+			return dbg.IAm(), fmt.Sprintf("%+v: %v", tc.o, err), true
+		}
+	}
+	return dbg.IAm(), "", false
+}
+
+func testTmplEscapes() (string, string, bool) {
+	t, err := compileTmpl("-f", `a\tb\0c\\n\x41\u00e9\q%f\`, true, fileToks)
+	if nil != err {
+		return dbg.IAm(), err.Error(), true
+	}
+	var b bytes.Buffer
+	out := bufio.NewWriter(&b)
+	t.render(out, tokenMap{"f": "F"})
+	out.Flush()
+	if want := "a\tb\x00c\\nAé\\qF\\"; b.String() != want {
+		return dbg.IAm(), fmt.Sprintf("%q", b.String()), true
+	}
+	return dbg.IAm(), "", false
+}
+
+func testLongTokens() (string, string, bool) {
+	tm := benchMap()
+	tm["p"] = "Dir 1/Sub1"
+	for _, tc := range []struct{ src, out string }{
+		{"%{f|lower|sep:@}", `'dir 1@sub1@file name.ext'`},
+		{"%{N|upper}.%{e}", `'FILE NAME'.Ext`},
+		{"%{path|sep}/%{name}", `'Dir 1@Sub1'/'File Name.Ext'`},
+		{`%{p|sep:\|}%{p|sep:\}}`, `'Dir 1|Sub1''Dir 1}Sub1'`},
+		{"%{c|sep:x}%{total}%{%}", "71234%"},
+		{"%@f %uN %lE", `'Dir 1@Sub1@File Name.Ext' 'FILE NAME' .ext`},
+	} {
+		t, err := compileTmpl("-f", tc.src, true, fileToks)
+		if nil != err {
+			return dbg.IAm(), err.Error(), true
+		}
+		var b bytes.Buffer
+		out := bufio.NewWriter(&b)
+		t.render(out, tm)
+		out.Flush()
+		if b.String() != tc.out {
+			return dbg.IAm(), fmt.Sprintf("%q: %q", tc.src, b.String()), true
+		}
+	}
+	for _, tc := range []struct{ src, err string }{
+		{"%f %{nope}", `-f: column 6: unknown token "%{nope}"`},
+		{"%f %{f|nope}", `-f: column 8: unknown modifier "nope"`},
+		{"%f %{f|upper:x}", `-f: column 8: modifier "upper": takes no argument`},
+		{"%f %{f|upper", `-f: column 4: missing '}' of %{`},
+		{"%{a}", `-f: column 3: token "%{a}" cannot be used here`},
+	} {
+		_, err := compileTmpl("-f", tc.src, true, fileToks)
+		if fmt.Sprint(err) != tc.err {
+			return dbg.IAm(), fmt.Sprintf("%q: %v", tc.src, err), true
+		}
+	}
+	return dbg.IAm(), "", false
+}
+
+// renderTmpl compiles and renders src as a -f string
+func renderTmpl(src string, tm tokenMap) (string, error) {
+	t, err := compileTmpl("-f", src, true, fileToks+entryToks+nowTok+pathToks)
+	if nil != err {
+		return "", err
+	}
+	var b bytes.Buffer
+	out := bufio.NewWriter(&b)
+	t.render(out, tm)
+	out.Flush()
+	return b.String(), nil
+}
+
+func testModifiers() (string, string, bool) {
+	tm := benchMap()
+	for _, tc := range []struct{ src, out string }{
+		{"%{n|replace: :_}", "File_Name.Ext"},
+		{"%{f|replace:/:\\:}", `'Dir 1:Sub1:File Name.Ext'`},
+		{"%{N|regex:[aeiou]:}", `'Fl Nm'`},
+		{"%{f|regex:^([^/]*)/.*$:$1}", `'Dir 1'`},
+		{"%{N|slice:0:4}|%{N|slice:-4}|%{N|slice:5:}|%{N|slice:2:-2}|%{N|slice:20}", "File|Name|Name|'le Na'|"},
+		{"%{n|trimprefix:File }|%{n|trimsuffix:.Ext}|%{e|trim:xE}", "Name.Ext|'File Name'|t"},
+		{"%{N|maxlen:3}|%{N|maxlen:30}|%{N|upper|maxlen:1}", "Fil|'File Name'|F"},
+	} {
+		out, err := renderTmpl(tc.src, tm)
+		if nil != err || out != tc.out {
+			return dbg.IAm(), fmt.Sprintf("%q: %q %v", tc.src, out, err), true
+		}
+	}
+	for _, tc := range []struct{ src, err string }{
+		{"%{n|replace:x}", `-f: column 5: modifier "replace": needs 2 argument(s)`},
+		{"%{n|replace::x}", `-f: column 5: modifier "replace": nothing to replace`},
+		{"%{n|regex:(:x}", "-f: column 5: modifier \"regex\": error parsing regexp: missing closing ): `(`"},
+		{"%{n|slice:a}", `-f: column 5: modifier "slice": "a" is not a number`},
+		{"%{n|slice:1:2:3}", `-f: column 5: modifier "slice": takes at most 2 argument(s)`},
+		{"%{n|maxlen:-1}", `-f: column 5: modifier "maxlen": "-1" is not a length`},
+	} {
+		if _, err := renderTmpl(tc.src, tm); fmt.Sprint(err) != tc.err {
+			return dbg.IAm(), fmt.Sprintf("%q: %v", tc.src, err), true
+		}
+	}
+	return dbg.IAm(), "", false
+}
+
+func testCaseModifiers() (string, string, bool) {
+	for _, tc := range []struct{ n, mods, out string }{
+		{"my file-name.v2.txt", "title", "MyFileNameV2Txt"},
+		{"my file-name.v2.txt", "camel", "myFileNameV2Txt"},
+		{"my file-name.v2.txt", "snake", "my_file_name_v2_txt"},
+		{"my file-name.v2.txt", "kebab", "my-file-name-v2-txt"},
+		{"HTTPServer_config", "snake", "http_server_config"},
+		{"parseJSONFile2Go", "kebab", "parse-json-file2-go"},
+		{"iconX", "snake|upper", "ICON_X"},
+		{"ÉtéFile", "camel", "étéFile"},
+		{"2 big-files.png", "cident", "_2_big_files_png"},
+		{"", "cident", "_"},
+		{" -- ", "title", ""},
+	} {
+		out, err := renderTmpl("%{n|"+tc.mods+"}", tokenMap{"n": tc.n})
+		if nil != err || out != tc.out {
+			return dbg.IAm(), fmt.Sprintf("%q|%s: %q %v", tc.n, tc.mods, out, err), true
+		}
+	}
+	return dbg.IAm(), "", false
+}
+
+func testNumberFormats() (string, string, bool) {
+	for _, tc := range []struct{ src, s, out string }{
+		{"%{s|iec} %{s|si}", "1536", "1.5Ki 1.5k"},
+		{"%{s|iec} %{s|si}", "1024", "1Ki 1k"},
+		{"%{s|iec} %{s|si}", "999", "999 999"},
+		{"%{s|iec} %{s|si}", "10300", "10Ki 10k"},
+		{"%{s|iec} %{s|si}", "10239", "10Ki 10k"},
+		{"%{s|iec} %{s|si}", "5000000000", "4.7Gi 5G"},
+		{"%{s|si} %{s|iec}", "999999", "1M 977Ki"},
+		{"%{s|iec} %{s|si}", "1048575", "1Mi 1M"},
+		{"%{s|si}", "-999999", "-1M"},
+		{"%{s|si}", "999499", "999k"},
+		{"%{s|thousands} %{s|thousands:.} %{s|thousands: }", "1234567", "1,234,567 1.234.567 1 234 567"},
+		{"%{s|thousands}", "-1234", "-1,234"},
+		{"%{s|thousands}", "123", "123"},
+		{"%{s|hex} %{s|oct} %{s|hex|pad:8:0} %{s|pad:5}|", "255", "ff 377 000000ff   255|"},
+		{"%08{inode} % 6{s} %03{uid} %04{size|hex}", "42", "00000042     42 007 002a"},
+		{"[%{uid|hex}] [%{uid|iec}] [%{uid|pad:3:0}]", "", "[] [] [000]"},
+	} {
+		tm := tokenMap{"s": tc.s, "inode": tc.s, "uid": "7"}
+		if strings.Contains(tc.src, "[") {
+			tm["uid"] = tc.s
+		}
+		out, err := renderTmpl(tc.src, tm)
+		if nil != err || out != tc.out {
+			return dbg.IAm(), fmt.Sprintf("%q %s: %q %v", tc.src, tc.s, out, err), true
+		}
+	}
+	for _, tc := range []struct{ src, err string }{
+		{"%05{f}", `-f: column 1: cannot set a width for "%05{f}"`},
+		{"%05{nope}", `-f: column 5: unknown token "%{nope}"`},
+		{"%{s|pad:x}", `-f: column 5: modifier "pad": "x" is not a width`},
+		{"%{s|pad:3:ab}", `-f: column 5: modifier "pad": pad "ab" is not a single character`},
+	} {
+		if _, err := renderTmpl(tc.src, tokenMap{}); fmt.Sprint(err) != tc.err {
+			return dbg.IAm(), fmt.Sprintf("%q: %v", tc.src, err), true
+		}
+	}
+	return dbg.IAm(), "", false
+}
+
+func testAlign() (string, string, bool) {
+	opts.Recursive = true
+	opts.FS = fstest.MapFS{
+		"top/a.txt":           {Data: []byte("1")},
+		"top/long name.txt":   {Data: []byte("12345678901")},
+		"top/sub/b":           {Data: []byte("123")},
+		"top/sub/much longer": {Data: []byte("12")},
+	}
+	opts.LeadOutput = "# %{%|left:3}|"
+	opts.DirOutput = "# %{D|right}"
+	opts.FileOutput = "mv %{f|left} %{s|right} %{n|right:6}|"
+	for _, tc := range []struct{ align, expect string }{
+		{"", "# %  |\n" +
+			"#   .\n" +
+			"mv top/a.txt              1  a.txt|\n" +
+			"mv 'top/long name.txt'   11 'long name.txt'|\n" +
+			"# sub\n" +
+			"mv top/sub/b              3      b|\n" +
+			"mv 'top/sub/much longer'  2 'much longer'|\n"},
+		{"dir", "# %  |\n" +
+			"# .\n" +
+			"mv top/a.txt            1  a.txt|\n" +
+			"mv 'top/long name.txt' 11 'long name.txt'|\n" +
+			"# sub\n" +
+			"mv top/sub/b             3      b|\n" +
+			"mv 'top/sub/much longer' 2 'much longer'|\n"},
+	} {
+		outTo.Reset()
+		opts.Align = tc.align
+		w, err := NewWalker(opts)
+		if nil != err {
+			return dbg.IAm(), err.Error(), true
+		}
+		w.Run(outTo, []string{"top"})
+		if got := outTo.buffer.String(); got != tc.expect {
+			return dbg.IAm(), got, true
+		}
+	}
+	for _, tc := range []struct{ src, err string }{
+		{"%{f|left|right}", `-f: column 10: modifier "right": token already aligned`},
+		{"%{f|left:0}", `-f: column 5: modifier "left": "0" is not a width`},
+	} {
+		if _, err := renderTmpl(tc.src, tokenMap{}); fmt.Sprint(err) != tc.err {
+			return dbg.IAm(), fmt.Sprintf("%q: %v", tc.src, err), true
+		}
+	}
+	if _, err := NewWalker(Options{Align: "x"}); err != Err_Align {
+		return dbg.IAm(), fmt.Sprint(err), true
+	}
+	return dbg.IAm(), "", false
+}
+
+func testCounters() (string, string, bool) {
+	opts = Options{Recursive: true, DontHomify: true, FS: fstest.MapFS{
+		"top/a.jpg":     {},
+		"top/b.png":     {},
+		"top/c.jpg":     {},
+		"top/sub/d.jpg": {},
+		"top/sub/e.png": {},
+	}}
+	for _, tc := range []struct{ dir, file, expect string }{
+		{"", "%{seq:pad=4} %f", "0001 top/a.jpg\n0002 top/b.png\n0003 top/c.jpg\n0004 top/sub/d.jpg\n0005 top/sub/e.png\n"},
+		{"", "%{seq:start=10:step=-5} %04{seq:name=x:start=0:step=2}",
+			"10 0000\n5 0002\n0 0004\n-5 0006\n-10 0008\n"},
+		{"", "IMG_%{seq:pad=3:reset=dir}%E", "IMG_001.jpg\nIMG_002.png\nIMG_003.jpg\nIMG_001.jpg\nIMG_002.png\n"},
+		{"", "%{seq:reset=ext:name=e}%E %{seq:name=e}", "1.jpg 1\n1.png 1\n2.jpg 2\n3.jpg 3\n2.png 2\n"},
+		{"# %{seq:name=d} %D", "%{seq:name=d} %{seq:name=f:reset=root} %n",
+			"# 1 .\n2 1 a.jpg\n3 2 b.png\n4 3 c.jpg\n# 5 sub\n6 4 d.jpg\n7 5 e.png\n"},
+	} {
+		outTo.Reset()
+		opts.DirOutput, opts.FileOutput = tc.dir, tc.file
+		w, err := NewWalker(opts)
+		if nil != err {
+			return dbg.IAm(), err.Error(), true
+		}
+		w.Run(outTo, []string{"top"})
+		if got := outTo.buffer.String(); got != tc.expect {
+			return dbg.IAm(), fmt.Sprintf("%q: %q", tc.file, got), true
+		}
+	}
+	outTo.Reset()
+	opts.DirOutput, opts.FileOutput = "", "%{seq:reset=root}/%{seq:name=all} %n"
+	w, _ := NewWalker(opts)
+	w.Run(outTo, []string{"top/sub", "top/sub"})
+	if got := outTo.buffer.String(); got != "1/1 d.jpg\n2/2 e.png\n1/3 d.jpg\n2/4 e.png\n" {
+		return dbg.IAm(), got, true
+	}
+	outTo.Reset()
+	opts.FS = fstest.MapFS{"top/a/b/x": {}, "top/c/x": {}, "top/d/x": {}}
+	opts.DirOutput, opts.FileOutput = "%{seq:reset=dir} %D", "%{seq:reset=dir} %n"
+	w, _ = NewWalker(opts)
+	w.Run(outTo, []string{"top"})
+	if got := outTo.buffer.String(); got != "1 .\n2 a\n1 a/b\n1 x\n3 c\n1 x\n4 d\n1 x\n" {
+		return dbg.IAm(), got, true
+	}
+	outTo.Reset()
+	opts.FS = fstest.MapFS{"a/y.jpg": {}, "a/s/x.jpg": {}, "b/z.jpg": {}, "b/s/r.jpg": {}}
+	opts.DirOutput, opts.FileOutput = "", "%f %{seq:reset=dir}"
+	w, _ = NewWalker(opts)
+	w.Run(outTo, []string{"a", "b"})
+	if got := outTo.buffer.String(); got != "a/y.jpg 1\na/s/x.jpg 1\nb/z.jpg 1\nb/s/r.jpg 1\n" {
+		return dbg.IAm(), got, true
+	}
+	for _, tc := range []struct{ src, err string }{
+		{"%{seq:pad}", `-f: column 3: token "%{seq}": "pad" is not a key=value setting`},
+		{"%{seq:step=x}", `-f: column 3: token "%{seq}": "x" is not a number`},
+		{"%{seq:reset=file}", `-f: column 3: token "%{seq}": reset must be 'dir', 'ext' or 'root'`},
+		{"%{seq:from=1}", `-f: column 3: token "%{seq}": unknown setting "from"`},
+		{"%{seq:start=2} %{seq:start=3}", `-f: counter "" is set up twice`},
+	} {
+		if _, err := NewWalker(Options{FileOutput: tc.src}); fmt.Sprint(err) != tc.err {
+			return dbg.IAm(), fmt.Sprintf("%q: %v", tc.src, err), true
+		}
+	}
+	if _, err := NewWalker(Options{LeadOutput: "%{seq}"}); nil == err {
+		return dbg.IAm(), "-L %{seq}", true
+	}
+	return dbg.IAm(), "", false
+}
+
+func testPathTokens() (string, string, bool) {
+	opts = Options{Recursive: true, DontHomify: true, RelTo: "top/sub", FS: fstest.MapFS{
+		"top/a.jpg":     {},
+		"top/sub/d.jpg": {},
+	}}
+	opts.DirOutput = "# %{depth} %{part:1} [%{part:-2}] %{up} %{up:2} %{rel}"
+	opts.FileOutput = "%{depth} %{part:1} %{part:-2} %{up} %{up:2} %{rel}"
+	outTo.Reset()
+	w, err := NewWalker(opts)
+	if nil != err {
+		return dbg.IAm(), err.Error(), true
+	}
+	w.Run(outTo, []string{"top"})
+	if got := outTo.buffer.String(); got != "# 0 top [] . . ..\n"+
+		"1 top top top . ../a.jpg\n"+
+		"# 1 top [top] top . .\n"+
+		"2 top sub top/sub top d.jpg\n" {
+		return dbg.IAm(), got, true
+	}
+
+	dir, err := os.MkdirTemp("", "sf")
+	if nil != err {
+		return dbg.IAm(), err.Error(), true
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(dir+"/files/a", 0700)
+	os.WriteFile(dir+"/files/a/f", nil, 0600)
+	outTo.Reset()
+	opts = Options{Recursive: true, FileOutput: "ln -s %{rel} links/%n", RelTo: dir + "/links"}
+	w, _ = NewWalker(opts)
+	w.Run(outTo, []string{dir + "/files"})
+	if got := outTo.buffer.String(); got != "ln -s ../files/a/f links/f\n" {
+		return dbg.IAm(), got, true
+	}
+	os.WriteFile(dir+"/b.zip", archives()["build.zip"].Data, 0600)
+	outTo.Reset()
+	opts = Options{Recursive: true, FileOutput: "%f [%{rel}]"}
+	w, _ = NewWalker(opts)
+	w.Run(outTo, []string{dir + "/b.zip"})
+	if got := outTo.buffer.String(); got != "top/a.txt []\ntop/sub/b.txt []\n" {
+		return dbg.IAm(), got, true
+	}
+
+	tm := tokenMap{"H": "/home/me", "up": "~/a b/c", "part": "/x/y"}
+	for _, tc := range []struct{ src, out string }{
+		{"%{up:0}", `~/'a b/c'`},
+		{"%{up:2}", "~"},
+		{"%{up:3}", "/home"},
+		{"%{up:9}", "/"},
+		{"%{part:1}|%{part:2}|%{part:3}|%{part:-1}|%{part:-3}", "x|y||y|"},
+	} {
+		if got, err := renderTmpl(tc.src, tm); nil != err || got != tc.out {
+			return dbg.IAm(), fmt.Sprintf("%q: %q %v", tc.src, got, err), true
+		}
+	}
+	for _, tc := range []struct{ base, target, rel string }{
+		{"/a/b", "/a/b", "."},
+		{"/a/b", "/a/b/c/f", "c/f"},
+		{"/a/b/c", "/a/x/f", "../../x/f"},
+		{"/", "/a/f", "a/f"},
+		{"/a", "/", ".."},
+		{".", "d/f", "d/f"},
+	} {
+		if got := relPath(tc.base, tc.target); got != tc.rel {
+			return dbg.IAm(), fmt.Sprintf("%s %s: %q", tc.base, tc.target, got), true
+		}
+	}
+	for _, tc := range []struct{ src, err string }{
+		{"%{part}", `-f: column 3: token "%{part}": "" is not a component index (1.. or -1..)`},
+		{"%{part:0}", `-f: column 3: token "%{part}": "0" is not a component index (1.. or -1..)`},
+		{"%{up:-1}", `-f: column 3: token "%{up}": "-1" is not a number of levels`},
+		{"%{depth:1}", `-f: column 3: token "%{depth}" takes no argument`},
+	} {
+		if _, err := renderTmpl(tc.src, tokenMap{}); fmt.Sprint(err) != tc.err {
+			return dbg.IAm(), fmt.Sprintf("%q: %v", tc.src, err), true
+		}
+	}
+	return dbg.IAm(), "", false
+}
+
+// hashFS counts the files opened on it, refusing any file named 'locked'
+type hashFS struct {
+	fstest.MapFS
+	opens *int64
+}
+
+func (h hashFS) Open(name string) (fs.File, error) {
+	if path.Base(name) == "locked" {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	if fi, err := h.MapFS.Stat(name); nil == err && !fi.IsDir() {
+		atomic.AddInt64(h.opens, 1)
+	}
+	return h.MapFS.Open(name)
+}
+
+func testHashTokens() (string, string, bool) {
+	var opens int64
+	fsys := hashFS{fstest.MapFS{
+		"top/abc":    {Data: []byte("abc")},
+		"top/empty":  {},
+		"top/locked": {Data: []byte("x")},
+	}, &opens}
+	for _, tc := range []struct {
+		src, expect string
+		opens       int64
+	}{
+		{"%n", "abc\nempty\nlocked\n", 0},
+		{"%{md5} %n", "900150983cd24fb0d6963f7d28e17f72 abc\nd41d8cd98f00b204e9800998ecf8427e empty\n", 2},
+		{"%{sha1} %{crc32} %n", "a9993e364706816aba3e25717850c26c9cd0d89d 352441c2 abc\nda39a3ee5e6b4b0d3255bfef95601890afd80709 00000000 empty\n", 2},
+		{"%{sha256|slice:0:16} %n", "ba7816bf8f01cfea abc\ne3b0c44298fc1c14 empty\n", 2},
+	} {
+		opens = 0
+		outTo.Reset()
+		w, err := NewWalker(Options{FS: fsys, FileOutput: tc.src})
+		if nil != err {
+			return dbg.IAm(), err.Error(), true
+		}
+		w.Run(outTo, []string{"top"})
+		if got := outTo.buffer.String(); got != tc.expect || opens != tc.opens {
+			return dbg.IAm(), fmt.Sprintf("%q: %q %d opens", tc.src, got, opens), true
+		}
+	}
+
+	var sums [2]string // a tar is hashed as it is read, not reopened per member
+	for i, name := range []string{"build.tgz", "build.zip"} {
+		opens = 0
+		outTo.Reset()
+		w, _ := NewWalker(Options{Recursive: true, HiddenFiles: true, FS: hashFS{archives(), &opens}, FileOutput: "%{md5} %f"})
+		w.Run(outTo, []string{name})
+		if sums[i] = outTo.buffer.String(); "build.tgz" == name && 1 != opens {
+			return dbg.IAm(), fmt.Sprintf("%s opened %d times", name, opens), true
+		}
+	}
+	if expect := "5d41402abc4b2a76b9719d911017c592 top/a.txt\nd41d8cd98f00b204e9800998ecf8427e top/sub/.c\n49f68a5c8493ec2c0bf489821c21fc3b top/sub/b.txt\n"; sums[0] != expect || sums[1] != expect {
+		return dbg.IAm(), fmt.Sprintf("%q %q", sums[0], sums[1]), true
+	}
+
+	tree := bigTree(6, 3) // hashed ahead on 2 goroutines, output in walk order
+	var serial, hashed bytes.Buffer
+	w, _ := NewWalker(Options{Recursive: true, FS: tree, FileOutput: "%f"})
+	w.ProcessDir(&serial, "tree")
+	w, _ = NewWalker(Options{Recursive: true, FS: tree, FileOutput: "%f %{sha1}", Jobs: 2})
+	w.ProcessDir(&hashed, "tree")
+	lines := strings.Split(strings.TrimSuffix(hashed.String(), "\n"), "\n")
+	if strings.Count(serial.String(), "\n") != len(lines) {
+		return dbg.IAm(), hashed.String(), true
+	}
+	for i, f := range strings.Split(serial.String(), "\n")[:len(lines)] {
+		if expect := fmt.Sprintf("%s %x", f, sha1.Sum(tree[f].Data)); lines[i] != expect {
+			return dbg.IAm(), lines[i] + " != " + expect, true
+		}
+	}
+
+	if _, err := NewWalker(Options{DirOutput: "%{md5}"}); nil == err {
+		return dbg.IAm(), "-d %{md5}", true
+	}
+	return dbg.IAm(), "", false
+}
+
+// hostileNames are file names that break naively quoted scripts
+var hostileNames = []string{
+	"plain.txt", "a b", "it's", `x"y`, "$(rm -rf ~)", "`id`", "a&b", "a;b", "*", "a?[b]",
+	"!!", "new\nline", "tab\there", "-rf", "--", "#hash", "~user", "back\\slash", "a|b>c<d",
+	"{a,b}", "$HOME", "%PATH%", "ctl\x01\x7f", "bidi\u202etxt.exe", "bad\xffutf8", "café", "'", "\"\"",
+}
+
+// shellArgs runs the shell on printf with the quoted args, returning the
+// args as the shell saw them
+func shellArgs(shell string, quoted []string) ([]string, error) {
+	cmd := exec.Command(shell, "-c", "printf '%s\\0' "+strings.Join(quoted, " "))
+	cmd.Env = []string{"HOME=/home/me", "PATH=" + os.Getenv("PATH")}
+	out, err := cmd.Output()
+	if nil != err {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00"), nil
+}
+
+func testQuoteDialects() (string, string, bool) {
+	for _, shell := range []string{"sh", "bash"} {
+		if _, err := exec.LookPath(shell); nil != err {
+			continue
+		}
+		quoted, expect := []string{}, []string{}
+		for _, nm := range hostileNames {
+			if "sh" == shell && !utf8.ValidString(nm) {
+				continue
+			}
+			quoted = append(quoted, quoter(shell, false, false)(nm), quoter(shell, true, true)(nm))
+			if '-' == nm[0] {
+				expect = append(expect, nm, "./"+nm)
+			} else {
+				expect = append(expect, nm, nm)
+			}
+		}
+		quoted = append(quoted, quoter(shell, true, false)("~/a b"), quoter(shell, true, false)("~"))
+		expect = append(expect, "/home/me/a b", "/home/me")
+		got, err := shellArgs(shell, quoted)
+		if nil != err {
+			return dbg.IAm(), shell + ": " + err.Error(), true
+		}
+		for i := range expect {
+			if i >= len(got) || got[i] != expect[i] {
+				return dbg.IAm(), fmt.Sprintf("%s: %q gave %q", shell, quoted[i], got), true
+			}
+		}
+	}
+
+	for _, tc := range []struct{ dialect, in, out string }{
+		{"bash", "new\nline", `$'new\nline'`},
+		{"bash", "it's\x01", `$'it\'s\x01'`},
+		{"bash", "bidi\u202etxt", `$'bidi\xe2\x80\xaetxt'`},
+		{"sh", "it's", `'it'\''s'`},
+		{"sh", "café.jpg", "café.jpg"},
+		{"fish", `it's a\b`, `'it\'s a\\b'`},
+		{"powershell", "it’s $x", "'it’’s $x'"},
+		{"powershell", "a-b", "'a-b'"},
+		{"cmd", `50% "off"`, `"50%% ""off"""`},
+		{"cmd", `dir\file.txt`, `dir\file.txt`},
+		{"make", "$(x) y", `'$$(x) y'`},
+		{"none", "a b'$", "a b'$"},
+	} {
+		q := quoter(tc.dialect, false, false)
+		if got := tc.in; nil != q {
+			got = q(tc.in)
+			if got != tc.out {
+				return dbg.IAm(), fmt.Sprintf("%s %q: %q", tc.dialect, tc.in, got), true
+			}
+		} else if "none" != tc.dialect {
+			return dbg.IAm(), tc.dialect, true
+		}
+	}
+
+	opts = Options{FS: fstest.MapFS{"top/-x y": {}, "top/plain": {}}, DontHomify: true, FileOutput: "rm %f # %n %E"}
+	for _, tc := range []struct{ dialect, expect string }{
+		{"", "rm 'top/-x y' # './-x y' \nrm top/plain # plain \n"},
+		{"powershell", "rm 'top/-x y' # './-x y' \nrm top/plain # plain \n"},
+		{"cmd", "rm \"top/-x y\" # \"./-x y\" \nrm top/plain # plain \n"},
+		{"none", "rm top/-x y # -x y \nrm top/plain # plain \n"},
+	} {
+		outTo.Reset()
+		opts.Quote = tc.dialect
+		w, err := NewWalker(opts)
+		if nil != err {
+			return dbg.IAm(), err.Error(), true
+		}
+		w.Run(outTo, []string{"top"})
+		if got := outTo.buffer.String(); got != tc.expect {
+			return dbg.IAm(), fmt.Sprintf("%q: %q", tc.dialect, got), true
+		}
+	}
+	outTo.Reset()
+	opts.Quote = ""
+	w, _ := NewWalker(opts)
+	w.Run(outTo, []string{"top/-x y"})
+	if got := outTo.buffer.String(); got != "" {
+		return dbg.IAm(), got, true
+	}
+	if _, err := NewWalker(Options{Quote: "zsh"}); err != Err_Quote {
+		return dbg.IAm(), fmt.Sprint(err), true
+	}
+	return dbg.IAm(), "", false
+}
+
+func testQuoteVariants() (string, string, bool) {
+	tm := tokenMap{"n": "it's $x", "F": "~/a \"b\"", "s": "42", "O": "~/my proj"}
+	for _, tc := range []struct{ src, out string }{
+		{"%n|%{n|raw}|%{n|quote}|%{n|quote:powershell}", `'it'\''s $x'|it's $x|'it'\''s $x'|'it''s $x'`},
+		{`"%{n|dq}" "%{F|dq}" %{F|raw}`, `"it's \$x" "$HOME/a \"b\"" ~/a "b"`},
+		{"%{n|upper|quote:sh}|%{n|quote:none}|%{s|quote}", `'IT'\''S $X'|it's $x|42`},
+		{"%{F|quote:fish|left:12}|", `~/'a "b"'   |`},
+		{"cd %O; cd %{O|quote}; cd %O/x", `cd ~/'my proj'; cd ~/'my proj'; cd ~/'my proj'/x`},
+	} {
+		if got, err := renderTmpl(tc.src, tm); nil != err || got != tc.out {
+			return dbg.IAm(), fmt.Sprintf("%q: %q %v", tc.src, got, err), true
+		}
+	}
+	if _, err := exec.LookPath("bash"); nil == err {
+		q, quoted, expect := dqQuoter(false), []string{}, []string{}
+		for _, nm := range hostileNames {
+			if utf8.ValidString(nm) {
+				quoted, expect = append(quoted, `"`+q(nm)+`"`), append(expect, nm)
+			}
+		}
+		got, err := shellArgs("bash", quoted)
+		if nil != err || strings.Join(got, "\x00") != strings.Join(expect, "\x00") {
+			return dbg.IAm(), fmt.Sprintf("%q %v", got, err), true
+		}
+	}
+
+	opts = Options{FS: fstest.MapFS{"top/a b": {}}, DontHomify: true, Quote: "none", FileOutput: "%f %{f|quote} %{n|quote:cmd}"}
+	outTo.Reset()
+	w, _ := NewWalker(opts)
+	w.Run(outTo, []string{"top"})
+	if got := outTo.buffer.String(); got != "top/a b 'top/a b' \"a b\"\n" {
+		return dbg.IAm(), got, true
+	}
+	opts = Options{FS: fstest.MapFS{"-x/-y": {}}, Recursive: true, DirOutput: "mkdir out_%D %D", FileOutput: "cp %f bk_%f"}
+	outTo.Reset()
+	w, _ = NewWalker(opts)
+	w.Run(outTo, []string{"."})
+	if got := outTo.buffer.String(); got != "mkdir out_. .\nmkdir out_-x ./-x\ncp ./-x/-y bk_-x/-y\n" {
+		return dbg.IAm(), got, true
+	}
+	opts = Options{FS: fstest.MapFS{"top/-rf": {}}, FileOutput: "cd %P && rm %n %N|%{n|raw}|bk_%n"}
+	outTo.Reset()
+	w, _ = NewWalker(opts)
+	w.Run(outTo, []string{"top"})
+	if got := outTo.buffer.String(); got != "cd top && rm ./-rf ./-rf|-rf|bk_-rf\n" {
+		return dbg.IAm(), got, true
+	}
+	for _, tc := range []struct{ src, err string }{
+		{"%{n|raw|dq}", `-f: column 9: modifier "dq": token already quoted`},
+		{"%{n|quote:zsh}", `-f: column 5: modifier "quote": unknown quoting dialect "zsh"`},
+		{"%{n|raw:x}", `-f: column 5: modifier "raw": takes no argument`},
+		{"%{n|quote:sh:x}", `-f: column 5: modifier "quote": takes at most 1 argument(s)`},
+	} {
+		if _, err := renderTmpl(tc.src, tokenMap{}); fmt.Sprint(err) != tc.err {
+			return dbg.IAm(), fmt.Sprintf("%q: %v", tc.src, err), true
+		}
+	}
+	return dbg.IAm(), "", false
+}
+
+func testNullOutput() (string, string, bool) {
+	opts = Options{Null: true, DontHomify: true, FS: fstest.MapFS{
+		"top/a b":       {},
+		"top/new\nline": {},
+	}}
+	for _, tc := range []struct{ lead, file, expect string }{
+		{"", "%f", "top/a b\x00top/new\nline\x00"},
+		{"# %%", "%{n|left}|%{n|quote}", "# %\x00a b     |'a b'\x00new\nline|$'new\\nline'\x00"},
+	} {
+		outTo.Reset()
+		opts.LeadOutput, opts.FileOutput = tc.lead, tc.file
+		w, err := NewWalker(opts)
+		if nil != err {
+			return dbg.IAm(), err.Error(), true
+		}
+		w.Run(outTo, []string{"top"})
+		if got := outTo.buffer.String(); got != tc.expect {
+			return dbg.IAm(), fmt.Sprintf("%q", got), true
+		}
+	}
+	for _, o := range []Options{{Null: true, BashHeader: true}, {Null: true, Quote: "sh"}} {
+		if _, err := NewWalker(o); err != Err_Null {
+			return dbg.IAm(), fmt.Sprint(err), true
+		}
+	}
+	return dbg.IAm(), "", false
+}
+
+// testHardenedScript checks the -B header wraps each -d / -f line in
+// sf_run, and that the script only echoes with DRY_RUN and refuses to run
+// out of its origin dir
+func testHardenedScript() (string, string, bool) {
+	opts = Options{Harden: true, DontHomify: true, FS: fstest.MapFS{
+		"top/it's.JPG": {},
+	}}
+	opts.LeadOutput, opts.FileOutput = "# %%", "mv %f %{N|lower}.jpg"
+	w, err := NewWalker(opts)
+	if nil != err {
+		return dbg.IAm(), err.Error(), true
+	}
+	outTo.Reset()
+	w.Run(outTo, []string{"top"})
+	got := outTo.buffer.String()
+	expect := "# %\n" + `sf_run 'mv '\''top/it'\''\'\'''\''s.JPG'\'' '\''it'\''\'\'''\''s'\''.jpg'` + "\n"
+	if !strings.HasPrefix(got, "#!/bin/bash") || !strings.Contains(got, "set -euo pipefail\n") ||
+		!strings.HasSuffix(got, expect) {
+		return dbg.IAm(), got, true
+	}
+	for _, o := range []Options{{Harden: true, Quote: "powershell"}, {Harden: true, Quote: "none"}, {Journal: "j", Quote: "fish"}} {
+		if _, err := NewWalker(o); err != Err_Harden {
+			return dbg.IAm(), fmt.Sprintf("%+v: %v", o, err), true
+		}
+	}
+	if _, err := NewWalker(Options{Harden: true, Quote: "sh"}); nil != err {
+		return dbg.IAm(), err.Error(), true
+	}
+	if _, err := exec.LookPath("bash"); nil != err || "linux" != runtime.GOOS {
+		return dbg.IAm(), "", false
+	}
+
+	dir, err := os.MkdirTemp("", "sf")
+	if nil != err {
+		return dbg.IAm(), err.Error(), true
+	}
+	defer os.RemoveAll(dir)
+	os.WriteFile(dir+"/it's.JPG", nil, 0600)
+	opts = Options{Harden: true, DontHomify: true, FileOutput: "mv %F %P/%{N|lower}.jpg"}
+	w, _ = NewWalker(opts)
+	outTo.Reset()
+	w.Run(outTo, []string{dir})
+	script := outTo.buffer.String()
+	run := func(at string, env ...string) (string, error) {
+		cmd := exec.Command("bash", "-c", script)
+		cmd.Dir, cmd.Env = at, append(os.Environ(), env...)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	if out, err := run(dir); nil == err || !strings.Contains(out, "Run this script from") {
+		return dbg.IAm(), "ran out of its origin: " + out, true
+	}
+	if out, err := run(".", "DRY_RUN=1"); nil != err || !strings.Contains(out, "# sf: 1 command(s) echoed, not run") {
+		return dbg.IAm(), fmt.Sprint(out, err), true
+	} else if _, err = os.Stat(dir + "/it's.JPG"); nil != err {
+		return dbg.IAm(), "DRY_RUN ran the command", true
+	}
+	if out, err := run("."); nil != err || !strings.Contains(out, "# sf: 1 command(s) run") {
+		return dbg.IAm(), fmt.Sprint(out, err), true
+	} else if _, err = os.Stat(dir + "/it's.jpg"); nil != err {
+		return dbg.IAm(), "the command was not run", true
+	}
+	return dbg.IAm(), "", false
+}
+
+// testJournal checks a -J script numbers its commands, and that a re-run
+// skips those done before it failed
+func testJournal() (string, string, bool) {
+	opts = Options{Journal: "sf.journal", FileOutput: "touch %n", FS: fstest.MapFS{
+		"top/a": {},
+		"top/b": {},
+	}}
+	w, err := NewWalker(opts)
+	if nil != err {
+		return dbg.IAm(), err.Error(), true
+	}
+	outTo.Reset()
+	w.Run(outTo, []string{"top"})
+	got := outTo.buffer.String()
+	if !strings.Contains(got, "SF_JOURNAL=sf.journal\n") || !strings.HasSuffix(got, "\nsf_run 1 'touch a'\nsf_run 2 'touch b'\n") {
+		return dbg.IAm(), got, true
+	}
+	if _, err := exec.LookPath("bash"); nil != err || "linux" != runtime.GOOS {
+		return dbg.IAm(), "", false
+	}
+
+	dir, err := os.MkdirTemp("", "sf")
+	if nil != err {
+		return dbg.IAm(), err.Error(), true
+	}
+	defer os.RemoveAll(dir)
+	for _, n := range []string{"a.txt", "b.txt", "c.txt", "b.stop"} {
+		os.WriteFile(dir+"/"+n, nil, 0600)
+	}
+	opts = Options{Journal: dir + "/journal", Include: "txt", DontHomify: true,
+		FileOutput: "echo %n >> %P/log; [[ ! -e %P/%N.stop ]]"}
+	w, _ = NewWalker(opts)
+	outTo.Reset()
+	w.Run(outTo, []string{dir})
+	script := outTo.buffer.String()
+	run := func() string {
+		out, _ := exec.Command("bash", "-c", script).CombinedOutput()
+		return string(out)
+	}
+	if out := run(); !strings.Contains(out, "# sf: 1 command(s) run, 0 skipped as done") {
+		return dbg.IAm(), out, true
+	}
+	os.Remove(dir + "/b.stop")
+	if out := run(); !strings.Contains(out, "# sf: 2 command(s) run, 1 skipped as done") {
+		return dbg.IAm(), out, true
+	}
+	log, _ := os.ReadFile(dir + "/log")
+	journal, _ := os.ReadFile(dir + "/journal")
+	if "a.txt\nb.txt\nb.txt\nc.txt\n" != string(log) || "1\n2\n3\n" != string(journal) {
+		return dbg.IAm(), fmt.Sprintf("%q %q", log, journal), true
+	}
+	return dbg.IAm(), "", false
+}
+
+// FuzzCompileTmpl checks the parser never panics, and that anything it
+// accepts renders
+func FuzzCompileTmpl(f *testing.F) {
+	for _, src := range append(benchTmpls, "%", "%u", "%0", "%@", "%0x", "% 9", "\\", "\\x4", "\\u00e9", "%\xff", "%{", "%{f|", "%{f|sep:\\}", "%{f|upper|sep:@}", "%{mtime:%Y %H:%M}", "%{now:age}", "%{mtime atime}", "%{uid gid|left}") {
+		f.Add(src, true)
+	}
+	tm := tokenMap{}
+	chars, names, _ := strings.Cut(allToks, " ")
+	for _, k := range chars {
+		tm[string(k)] = "v/" + string(k)
+	}
+	for _, k := range strings.Fields(names) {
+		tm[k] = "1000000000"
+	}
+	f.Fuzz(func(t *testing.T, src string, escapes bool) {
+		tmpl, err := compileTmpl("-f", src, escapes, allToks)
+		if nil != err {
+			if _, ok := err.(*TmplError); !ok {
+				t.Fatalf("%q: %T error", src, err)
+			}
+			return
+		}
+		for i := range tmpl {
+			if nil != tmpl[i].seq {
+				tm[tmpl[i].key] = "1"
+			}
+		}
+		tmpl.render(bufio.NewWriter(io.Discard), tm)
+	})
+}
+
+func BenchmarkLegacyReplace(b *testing.B) {
+	tm := legacyMap(benchMap())
+	for i := 0; i < b.N; i++ {
+		for _, src := range benchTmpls {
+			fmt.Fprintln(io.Discard, strings.ReplaceAll(legacyReplace(tm, src), "\\n", "\n"))
+		}
+	}
+}
+
+func BenchmarkCompiledRender(b *testing.B) {
+	tm := benchMap()
+	tmpls := []template{}
+	for _, src := range benchTmpls {
+		t, _ := compileTmpl("-f", src, true, fileToks)
+		tmpls = append(tmpls, t)
+	}
+	out := bufio.NewWriter(io.Discard)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, t := range tmpls {
+			t.output(out, tm, '\n')
+		}
+	}
+	out.Flush()
+}
+
+func TestWalker(t *testing.T) {
+	if tst.Testing(dbg.IAm(), "", true) {
+		tst.Func(t, testRunLeadTail)
+		tst.Func(t, testWalkersIndependent)
+		tst.Func(t, testVisitorOrder)
+		tst.Func(t, testFSOddNames)
+		tst.Func(t, testFSPermission)
+		tst.Func(t, testTimeTokens)
+		tst.Func(t, testStatTokens)
+		tst.Func(t, testArchives)
+		tst.Func(t, testTarMemberData)
+		tst.Func(t, testJobsMatchSerial)
+		tst.Func(t, testStreamMatchesSorted)
+		tst.Func(t, testDeepTree)
+		tst.Func(t, testSingleStat)
+		tst.Func(t, testCompiledMatchesLegacy)
+		tst.Func(t, testTmplErrors)
+		tst.Func(t, testTmplEscapes)
+		tst.Func(t, testLongTokens)
+		tst.Func(t, testModifiers)
+		tst.Func(t, testCaseModifiers)
+		tst.Func(t, testNumberFormats)
+		tst.Func(t, testAlign)
+		tst.Func(t, testCounters)
+		tst.Func(t, testPathTokens)
+		tst.Func(t, testHashTokens)
+		tst.Func(t, testQuoteDialects)
+		tst.Func(t, testQuoteVariants)
+		tst.Func(t, testNullOutput)
+		tst.Func(t, testHardenedScript)
+		tst.Func(t, testJournal)
+		tst.Func(t, testHeadTailArgs)
+	}
+}
+
 func TestDirs(t *testing.T) {
 	if tst.Testing(dbg.IAm(), "", true) {
 		tst.Func(t, testDirsNonRecursive)